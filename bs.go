@@ -5,92 +5,605 @@ package sbbs
 import (
 	"context"
 	"errors"
-	"log"
-	"maps"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
 	"os"
+	"os/signal"
 	"slices"
-	"strings"
+	"syscall"
+	"time"
 )
 
 type (
-	// The function that will be executed when a target is run. This function
-	// will be given all of the leftover cmd line arguments that were supplied
-	// after the target. Parsing of these arguments is up to the logic defined
-	// be the targets stages.
-	TargetFunc func(cmdLineArgs ...string)
-
-	// The function that will be executed to perform an operation for a given
-	// target. The supplied context is meant to be used to control the runtime
-	// of the stage operation.
+	// An operation that is performed as part of a given target. Stages are
+	// created with [Stage], which names the stage so that it can be listed in
+	// a targets help without being run. Stages that wrap other stages, such
+	// as [Retry] or [When], are listed under the names of the stages they
+	// wrap.
+	Stager interface {
+		// Runs the stage. The supplied context is meant to be used to control
+		// the runtime of the stage operation.
+		Run(ctxt context.Context, cmdLineArgs ...string) error
+		// Returns the names the stage is listed under in a targets help.
+		Names() []string
+	}
+
+	// A function that can be used as a [Stager]. Stages that are plain
+	// functions are listed as unnamed stages in a targets help, [Stage]
+	// should be used instead to give them a name.
 	StageFunc func(ctxt context.Context, cmdLineArgs ...string) error
+
+	// A set of targets that can be run together. Most build systems only need
+	// a single set of targets, which is provided by [DefaultBuildSystem] and
+	// used by all of the package level functions. Separate build systems can
+	// be created with [NewBuildSystem] when more than one is needed in a
+	// single process, such as when embedding the build system in a larger
+	// program or testing a build script.
+	BuildSystem struct {
+		// The targets that are available to be called in the build system.
+		// Targets are registered here through the [BuildSystem.RegisterTarget]
+		// method.
+		targets map[string]*Target
+		// Any errors that were encountered while registering targets. These
+		// are reported when the build system is validated.
+		registrationErrs []error
+	}
+
+	// A build target that has been registered with a build system. Targets
+	// are created through [BuildSystem.RegisterTarget] and can be further
+	// configured by chaining the methods defined on this type.
+	Target struct {
+		bs     *BuildSystem
+		name   string
+		ctxt   context.Context
+		stages []Stager
+		deps   []string
+		flags  []targetFlag
+		conds  []Condition
+		// The log level used for the targets stages, if it was set.
+		logLevel *LogLevel
+		// Stages that are run after the targets stages regardless of whether
+		// they succeeded, failed, or were cancelled.
+		finally []Stager
+		// The maximum amount of time the targets stages can run for. Zero
+		// means there is no timeout.
+		timeout time.Duration
+
+		description string
+		usage       string
+		category    string
+	}
+
+	// The error that is returned when a target fails. The wrapped error will
+	// be the error that caused the target to fail, which is usually a
+	// [StageError].
+	TargetError struct {
+		Target string
+		Err    error
+	}
+
+	// The error that is returned when a stage fails. The wrapped error will be
+	// the error that was returned by the stages operation.
+	StageError struct {
+		Stage string
+		Err   error
+	}
+
+	// The settings the requested targets are run with, which are parsed from
+	// the cmd line arguments given to [BuildSystem.MainCode].
+	runOpts struct {
+		progName    string
+		cmdLineArgs []string
+		reqs        []targetRequest
+		jobs        int
+		force       bool
+		watch       bool
+		timeout     time.Duration
+		// The paths the build report and JUnit report are written to after
+		// every run, and the path the JSON logs are appended to, if any.
+		report  string
+		junit   string
+		logJSON string
+	}
 )
 
 var (
-	// The targets that are available to be called in the build system created
-	// by the user. Targets are registered here through the [RegisterTarget]
-	// function.
-	targets = map[string]TargetFunc{}
+	// The build system that is used by all of the package level functions,
+	// such as [RegisterTarget], [RunTarget], and [Main].
+	DefaultBuildSystem = NewBuildSystem()
 
 	// An error that a stage can return to stop the target it is part of from
 	// further execution. This is intended to be used when other error
 	// information has been printed to the console.
 	StopErr = errors.New("Generic stop error. See log above for error details.")
+
+	// The cause given to the context of every running stage when the build
+	// system receives an interrupt, such as when Ctrl-C is pressed.
+	InterruptErr = errors.New("Interrupted")
 )
 
+// The exit code that is returned when the build system is interrupted, which
+// follows the shell convention of 128 plus the value of SIGINT.
+const interruptedExitCode = 130
+
+// Creates a new build system with no targets registered.
+func NewBuildSystem() *BuildSystem {
+	return &BuildSystem{targets: map[string]*Target{}}
+}
+
+// Calls [BuildSystem.RegisterTarget] on the [DefaultBuildSystem].
+func RegisterTarget(
+	ctxt context.Context,
+	name string,
+	stages ...Stager,
+) *Target {
+	return DefaultBuildSystem.RegisterTarget(ctxt, name, stages...)
+}
+
 // Registers a new build target to the build system. When run, the new target
-// will sequentially run all provided stages, stopping if an error is
+// will first run all of the targets it depends on (see [Target.DependsOn]) and
+// will then sequentially run all provided stages, stopping if an error is
 // encountered.
-func RegisterTarget(ctxt context.Context, name string, stages ...StageFunc) {
-	if _, ok := targets[name]; ok {
-		LogPanic("Duplicate target name: %s", name)
-	}
-	targets[name] = func(cmdLineArgs ...string) {
-		for i := range stages {
-			if err := stages[i](ctxt, cmdLineArgs...); err != nil {
-				// Note that the error was already printed out by the stage, it
-				// does not need to be printed out here. It is meerly returned
-				// to indicate if execution of the target should stop.
-				LogPanic("An error was encountered, exiting.")
-			}
+func (b *BuildSystem) RegisterTarget(
+	ctxt context.Context,
+	name string,
+	stages ...Stager,
+) *Target {
+	t := &Target{bs: b, name: name, ctxt: ctxt, stages: stages}
+	if _, ok := b.targets[name]; ok {
+		// The returned target is not registered so that any further
+		// configuration does not modify the original target.
+		b.registrationErrs = append(
+			b.registrationErrs,
+			fmt.Errorf("Duplicate target name: %s", name),
+		)
+		return t
+	}
+	b.targets[name] = t
+	return t
+}
+
+func (t TargetError) Error() string {
+	return fmt.Sprintf("Target '%s': %s", t.Target, t.Err)
+}
+
+func (t TargetError) Unwrap() error {
+	return t.Err
+}
+
+func (s StageError) Error() string {
+	return fmt.Sprintf("Stage '%s': %s", s.Stage, s.Err)
+}
+
+func (s StageError) Unwrap() error {
+	return s.Err
+}
+
+// Adds the supplied targets as dependencies of the target. Dependencies are
+// run before the targets stages and each dependency will be run at most once
+// per invocation of the build system, regardless of how many targets depend
+// on it. Dependencies are referenced by name so they do not need to be
+// registered before the target that depends on them, but they must be
+// registered before [BuildSystem.Main] is called.
+func (t *Target) DependsOn(names ...string) *Target {
+	t.deps = append(t.deps, names...)
+	return t
+}
+
+// Returns the name of the target.
+func (t *Target) Name() string {
+	return t.name
+}
+
+// Runs the target and all of its dependencies, returning any error that was
+// encountered. See [BuildSystem.RunTarget] for details.
+func (t *Target) Run(ctxt context.Context, cmdLineArgs ...string) error {
+	return t.bs.RunTarget(ctxt, t.name, cmdLineArgs...)
+}
+
+// Runs the targets stages sequentially, stopping if an error is encountered.
+// The stages are given a context that is derived from the targets context and
+// that will also be cancelled if the supplied invocation is cancelled. The
+// invocation and the targets parsed flags are added to the context so that any
+// targets run from within a stage share the same invocation and so that stages
+// can access the targets flag values. If any of the targets conditions are not
+// met none of the stages are run and the target is recorded as skipped in the
+// supplied target run.
+func (t *Target) run(inv *invocation, r *targetRun, a targetArgs) error {
+	ctxt, cancel := context.WithCancelCause(t.ctxt)
+	defer cancel(nil)
+	stop := context.AfterFunc(inv.ctxt, func() {
+		cancel(context.Cause(inv.ctxt))
+	})
+	defer stop()
+	ctxt = context.WithValue(ctxt, invocationKey{}, inv)
+	ctxt = context.WithValue(ctxt, flagValuesKey{}, a.flags)
+	ctxt = context.WithValue(ctxt, targetRunKey{}, r)
+	if t.logLevel != nil {
+		ctxt = context.WithValue(ctxt, logLevelKey{}, *t.logLevel)
+	}
+
+	cond, err := t.unmetCondition(ctxt)
+	if err != nil {
+		LogErrContext(ctxt, "Target '%s': %s", t.name, err)
+		return TargetError{Target: t.name, Err: err}
+	} else if cond != nil {
+		LogSkipContext(ctxt, "Target '%s': Skipped, condition not met: %s", t.name, cond.Desc)
+		inv.mu.Lock()
+		r.skipped = cond.Desc
+		inv.mu.Unlock()
+		return nil
+	}
+
+	if t.timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctxt, cancelTimeout = withTimeout(
+			ctxt, fmt.Sprintf("Target '%s'", t.name), t.timeout,
+		)
+		defer cancelTimeout()
+	}
+
+	ctxt, cleanups := withCleanupScope(ctxt)
+	for i := range t.stages {
+		// Note that the error was already printed out by the stage, it does
+		// not need to be printed out here. It is meerly returned to indicate
+		// if execution of the target should stop.
+		if err = t.stages[i].Run(ctxt, a.args...); err != nil {
+			break
+		}
+	}
+
+	// Finally stages are given a context that is never cancelled so that they
+	// can clean up after the target even when it was cancelled or timed out.
+	finallyCtxt := context.WithoutCancel(ctxt)
+	for i := range t.finally {
+		if finallyErr := t.finally[i].Run(finallyCtxt, a.args...); finallyErr != nil {
+			err = errors.Join(err, finallyErr)
 		}
 	}
+	if cleanupErr := cleanups.run(); cleanupErr != nil {
+		err = errors.Join(err, cleanupErr)
+	}
+
+	if err != nil {
+		return TargetError{Target: t.name, Err: err}
+	}
+	return nil
 }
 
-func logUsage(progName string, availableTargets []string) {
-	slices.Sort(availableTargets)
-	LogInfo("Usage:")
-	LogInfo("\t%s [target | -h | --help] [target specific args...]", progName)
-	LogInfo("\tValid targets: %v", availableTargets)
+// Adds stages that are run after the targets stages, regardless of whether the
+// targets stages succeeded, failed, or were cancelled. All finally stages are
+// run even if one of them fails. They are given a context that is not
+// cancelled when the target is, so that they can reliably undo any changes the
+// target made, such as stopping services that were started for tests.
+func (t *Target) Finally(stages ...Stager) *Target {
+	t.finally = append(t.finally, stages...)
+	return t
 }
 
-// The main function that runs the build system. This is intended to be called
-// by the `main` function of any code that uses this library.
+// Calls [BuildSystem.Main] on the [DefaultBuildSystem].
 func Main(progName string) {
-	log.SetPrefix("smoothbrain-bs | ")
-	availableTargets := slices.Collect(maps.Keys(targets))
+	DefaultBuildSystem.Main(progName)
+}
+
+// Calls [BuildSystem.MainCode] on the [DefaultBuildSystem].
+func MainCode(progName string, cmdLineArgs []string) int {
+	return DefaultBuildSystem.MainCode(progName, cmdLineArgs)
+}
+
+// The main function that runs the build system. This is intended to be called
+// by the `main` function of any code that uses this library. The `-j N` flag
+// can be supplied before the target to run up to N independent targets
+// concurrently and the `-force` flag can be supplied to run all [Incremental]
+// stages regardless of whether they are up to date. The `-watch` flag reruns
+// the targets every time a file in the repository changes and the `-timeout D`
+// flag stops all targets once the duration D has passed. The `-v` and `-q`
+// flags make the logs more or less verbose, overriding the [LogLevelEnvVar] env
+// variable. The `-color=auto|always|never` flag controls when the logs are
+// colored, see [ColorMode], and the `-log-json PATH` flag additionally appends
+// every log message, including debug messages, to the file at PATH as JSON
+// lines, see [SetLogHandlers]. The `-report PATH` flag writes a JSON report to
+// PATH once the targets finish, describing every target, stage, and command
+// that was run along with its status and timing, and the `-junit PATH` flag
+// writes a JUnit XML report to PATH with a test case for every stage and for
+// every go test run with [RunGoTest]. Targets that rely on process wide state,
+// such as the current working directory, should declare dependencies between
+// each other so they are not run concurrently. The arguments after the flags
+// are interpreted in one of the following ways:
+//  1. `target [target...] -- [args...]`: All of the arguments before the `--`
+//     separator are targets and all of the arguments after it are given to the
+//     last target.
+//  2. `target [target...]`: If every argument is a target then each target is
+//     run with no arguments.
+//  3. `target [args...]`: Otherwise the first argument is the target and all
+//     other arguments are given to it.
+//
+// When more than one target is run a summary of which targets passed, failed,
+// or were skipped is printed at the end. Pressing Ctrl-C cancels the context
+// of every running stage, waits for the stages to stop, and reports which stage
+// was interrupted. Main exits the program with the exit code that is returned
+// by [BuildSystem.MainCode].
+func (b *BuildSystem) Main(progName string) {
+	os.Exit(b.MainCode(progName, os.Args[1:]))
+}
+
+// Runs the build system with the supplied cmd line arguments, which should not
+// include the program name, and returns the exit code the program should exit
+// with. Unlike [BuildSystem.Main] this function does not exit, allowing it to
+// be used when the build system is embedded in a larger program. If a second
+// interrupt is received every running command is killed and the exit code is
+// returned immediately, without waiting for the running stages to stop. Any
+// [Target.Finally] stages and cleanup functions that have not run yet are
+// skipped in that case.
+func (b *BuildSystem) MainCode(progName string, cmdLineArgs []string) int {
+	if name := os.Getenv(LogLevelEnvVar); name != "" {
+		l, err := ParseLogLevel(name)
+		if err != nil {
+			LogErr("Invalid value for %s: %s", LogLevelEnvVar, err)
+			return 1
+		}
+		SetLogLevel(l)
+	}
 
-	if len(os.Args) == 2 && slices.Contains([]string{"-h", "--help"}, strings.ToLower(os.Args[1])) {
-		logUsage(progName, availableTargets)
+	flags := flag.NewFlagSet(progName, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	jobs := flags.Int("j", 1, "")
+	force := flags.Bool("force", false, "")
+	watch := flags.Bool("watch", false, "")
+	timeout := flags.Duration("timeout", 0, "")
+	verbose := flags.Bool("v", false, "")
+	quiet := flags.Bool("q", false, "")
+	color := flags.String("color", ColorAuto.String(), "")
+	logJSON := flags.String("log-json", "", "")
+	report := flags.String("report", "", "")
+	junit := flags.String("junit", "", "")
+	if err := flags.Parse(cmdLineArgs); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			LogErr("Invalid flags: %s", err)
+		}
+		b.logUsage(progName)
 		LogQuietInfo("Consider: Re-runing with a target")
-		os.Exit(1)
+		return 1
+	}
+	args := flags.Args()
+	colorMode, err := ParseColorMode(*color)
+	if err != nil {
+		LogErr("%s", err)
+		return 1
+	}
+	SetColorMode(colorMode)
+	if *logJSON != "" {
+		f, err := os.OpenFile(
+			*logJSON, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644,
+		)
+		if err != nil {
+			LogErr("Could not open the log file: %s", err)
+			return 1
+		}
+		defer f.Close()
+		prevHandlers := *logHandlers.Load()
+		defer SetLogHandlers(prevHandlers...)
+		AddLogHandler(slog.NewJSONHandler(
+			f, &slog.HandlerOptions{Level: slog.Level(LevelDebug)},
+		))
+	}
+	if *verbose && *quiet {
+		LogErr("The -v and -q flags cannot be used together")
+		return 1
+	} else if *verbose {
+		SetLogLevel(LevelDebug)
+	} else if *quiet {
+		SetLogLevel(LevelWarn)
 	}
-	if len(os.Args) < 2 {
+
+	if len(args) > 0 && args[0] == helpTargetName {
+		if _, ok := b.targets[helpTargetName]; !ok {
+			return b.help(progName, args[1:]...)
+		}
+	}
+	if len(args) < 1 {
 		LogErr("Expected target to be provided.")
-		logUsage(progName, availableTargets)
+		b.logUsage(progName)
 		LogQuietInfo("Consider: Re-runing with a target")
-		os.Exit(1)
+		return 1
+	}
+	if *jobs < 1 {
+		LogErr("The number of jobs must be at least 1, got: %d", *jobs)
+		LogQuietInfo("Consider: Re-runing with a valid number of jobs")
+		return 1
+	}
+	if *timeout < 0 {
+		LogErr("The timeout must not be negative, got: %s", *timeout)
+		LogQuietInfo("Consider: Re-runing with a valid timeout")
+		return 1
 	}
 
-	if !slices.Contains(availableTargets, os.Args[1]) {
-		LogErr("An invalid target was provided")
-		logUsage(progName, availableTargets)
+	reqs, err := b.targetRequests(args)
+	if err != nil {
+		LogErr("%s", err)
+		b.logUsage(progName)
 		LogQuietInfo("Consider: Re-runing with a valid target")
-		os.Exit(1)
+		return 1
 	}
 
-	if len(os.Args) > 2 {
-		targets[os.Args[1]](os.Args[2:]...)
+	if err := b.validate(); err != nil {
+		LogErr("The build system is not valid: %s", err)
+		LogQuietInfo("Consider: Fixing the targets registration")
+		return 1
+	}
+
+	for _, req := range reqs {
+		if _, err := b.targets[req.name].parseArgs(req.args); err != nil {
+			if !errors.Is(err, flag.ErrHelp) {
+				LogErr("Invalid flags for target '%s': %s", req.name, err)
+			}
+			b.logTargetHelp(progName, b.targets[req.name])
+			LogQuietInfo("Consider: Re-runing with valid flags")
+			return 1
+		}
+	}
+
+	opts := runOpts{
+		progName:    progName,
+		cmdLineArgs: cmdLineArgs,
+		reqs:        reqs,
+		jobs:        *jobs,
+		force:       *force,
+		watch:       *watch,
+		timeout:     *timeout,
+		report:      *report,
+		junit:       *junit,
+		logJSON:     *logJSON,
+	}
+	ctxt, aborted, stop := interruptContext()
+	defer stop()
+	code := make(chan int, 1)
+	go func() {
+		if opts.watch {
+			code <- b.watch(ctxt, opts)
+		} else {
+			code <- b.runRequests(ctxt, opts)
+		}
+	}()
+	select {
+	case rv := <-code:
+		return rv
+	case <-aborted:
+		return interruptedExitCode
+	}
+}
+
+// Runs the requested targets once, logging a summary and writing the requested
+// reports once they finish. Returns the exit code the program should exit
+// with.
+func (b *BuildSystem) runRequests(ctxt context.Context, opts runOpts) int {
+	if opts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctxt, cancel = withTimeout(ctxt, "The build", opts.timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	inv := newInvocation(b, ctxt, opts.jobs)
+	inv.force = opts.force
+	inv.junit = opts.junit != ""
+	err := inv.runTargets(opts.reqs)
+	if len(opts.reqs) > 1 {
+		inv.logSummary(opts.reqs)
+	}
+	if opts.report != "" {
+		if reportErr := inv.writeReport(
+			opts.report, opts.progName, opts.cmdLineArgs, start, opts.reqs, err,
+		); reportErr != nil {
+			LogErr("Could not write the build report: %s", reportErr)
+			if err == nil {
+				return 1
+			}
+		}
+	}
+	if opts.junit != "" {
+		if junitErr := inv.writeJUnit(
+			opts.junit, opts.progName, start, opts.reqs,
+		); junitErr != nil {
+			LogErr("Could not write the JUnit report: %s", junitErr)
+			if err == nil {
+				return 1
+			}
+		}
+	}
+	if errors.Is(err, InterruptErr) {
+		logInterrupted(err)
+		return interruptedExitCode
+	} else if err != nil {
+		LogErr("An error was encountered, exiting.")
+		LogErr(multiLineIndent+"Cause: %s", err)
+		return 1
+	}
+	return 0
+}
+
+// Returns a context that is cancelled with [InterruptErr] as its cause when the
+// process receives an interrupt or termination signal, such as when Ctrl-C is
+// pressed. If a second signal is received every command that is still running
+// is killed, along with the processes it started, and the returned channel is
+// closed so the caller can stop waiting on the running stages. The returned
+// function stops listening for signals.
+func interruptContext() (context.Context, <-chan struct{}, func()) {
+	ctxt, cancel := context.WithCancelCause(context.Background())
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	aborted := make(chan struct{})
+
+	go func() {
+		select {
+		case sig := <-sigs:
+			LogWarn("Received %s, stopping all running stages...", sig)
+			LogWarn(multiLineIndent + "Interrupt again to exit immediately")
+			cancel(fmt.Errorf("%w: received %s", InterruptErr, sig))
+		case <-done:
+			return
+		}
+		select {
+		case sig := <-sigs:
+			LogErr("Received %s again, killing all running commands and exiting", sig)
+			killRunningCmds()
+			close(aborted)
+		case <-done:
+		}
+	}()
+
+	return ctxt, aborted, func() {
+		signal.Stop(sigs)
+		close(done)
+		cancel(nil)
+	}
+}
+
+// Logs which stage was running when the build system was interrupted. When
+// stages are nested, such as with [TargetAsStage], the innermost stage is
+// reported.
+func logInterrupted(err error) {
+	stage := ""
+	for se := (StageError{}); errors.As(err, &se); err = se.Err {
+		stage = se.Stage
+	}
+	if stage == "" {
+		LogErr("Interrupted, exiting.")
 	} else {
-		targets[os.Args[1]]()
+		LogErr("Interrupted while running stage '%s', exiting.", stage)
+	}
+}
+
+// Splits the supplied cmd line arguments into the targets that should be run.
+// See [BuildSystem.Main] for how the arguments are interpreted.
+func (b *BuildSystem) targetRequests(args []string) ([]targetRequest, error) {
+	isTarget := func(name string) bool {
+		_, ok := b.targets[name]
+		return ok
+	}
+
+	var names, targetArgs []string
+	if sep := slices.Index(args, "--"); sep >= 0 {
+		names, targetArgs = args[:sep], args[sep+1:]
+	} else if !slices.ContainsFunc(args, func(a string) bool { return !isTarget(a) }) {
+		names = args
+	} else {
+		names, targetArgs = args[:1], args[1:]
+	}
+	if len(names) == 0 {
+		return nil, errors.New("Expected target to be provided before '--'.")
+	}
+
+	reqs := make([]targetRequest, len(names))
+	for i, name := range names {
+		if !isTarget(name) {
+			return nil, fmt.Errorf("An invalid target was provided: %s", name)
+		}
+		reqs[i] = targetRequest{name: name}
 	}
+	reqs[len(reqs)-1].args = targetArgs
+	return reqs, nil
 }
@@ -6,6 +6,7 @@ import (
 
 func main() {
 	sbbs.RegisterBsBuildTarget()
+	sbbs.RegisterCacheTarget()
 	sbbs.RegisterUpdateDepsTarget()
 	sbbs.RegisterGoMarkDocTargets()
 	sbbs.RegisterCommonGoCmdTargets(sbbs.NewGoTargets().
@@ -0,0 +1,650 @@
+package sbbs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The env variable that can be used to override the directory the local
+	// build cache is stored in.
+	CacheDirEnvVar = "SBBS_CACHE_DIR"
+	// The env variable that can be used to override the maximum size of the
+	// local build cache. The value is a number of bytes, optionally followed
+	// by a K, M, or G suffix.
+	CacheMaxSizeEnvVar = "SBBS_CACHE_MAX_SIZE"
+
+	// The default maximum size of the local build cache, 1GiB.
+	defaultCacheMaxSize = 1 << 30
+	// Incremented whenever the layout of the cache changes so that old cache
+	// entries are not used.
+	cacheVersion = "1"
+)
+
+type (
+	// Defines what a cached stage depends on and what it produces. See
+	// [Cached].
+	CacheOpts struct {
+		// Identifies the stage in the cache. If empty, the name of the wrapped
+		// stage is used, in which case the wrapped stage must have been
+		// created with [Stage].
+		Key string
+		// Glob patterns matching the files the stage reads. Patterns are
+		// relative to the current working directory when the stage is run and
+		// a `**` path segment will match zero or more directories.
+		Inputs []string
+		// Glob patterns matching the files the stage produces. These follow
+		// the same rules as Inputs. Only files matching these patterns will be
+		// stored in and restored from the cache.
+		Outputs []string
+		// The command line the stage runs. This is only used to compute the
+		// cache key so that changing the command invalidates the cache.
+		Cmd []string
+		// The names of the env variables that affect the stages outputs. The
+		// values of these env variables are included in the cache key.
+		Env []string
+	}
+
+	// A content addressed store of stage outputs on the local file system.
+	// Files are stored once in the blobs directory, named by the sha256 hash
+	// of their contents, and each cache entry is a manifest in the entries
+	// directory that lists the files a stage produced. The modification time
+	// of a manifest records when it was last used. Files are first written to
+	// the tmp directory and are only moved into the blobs directory, along
+	// with writing the manifest that references them, while the cache is
+	// locked, see [localCache.lock].
+	localCache struct {
+		dir     string
+		maxSize int64
+	}
+
+	cacheManifest struct {
+		Key   string      `json:"key"`
+		Files []cacheFile `json:"files"`
+	}
+
+	cacheFile struct {
+		Path string      `json:"path"`
+		Hash string      `json:"hash"`
+		Mode fs.FileMode `json:"mode"`
+	}
+
+	// Statistics describing the contents of the local build cache.
+	cacheStats struct {
+		entries int
+		blobs   int
+		size    int64
+	}
+)
+
+// Guards modifying the local cache within this process. The cache is also
+// locked with a file lock so that processes that share the cache are guarded
+// as well, see [localCache.lock].
+var cacheMu sync.Mutex
+
+// Creates a stage that stores the outputs of the supplied stage in a content
+// addressed build cache, keyed by a hash of the stages inputs, command line,
+// and selected env variables. If an entry for the current key is present the
+// outputs are restored from the cache and the stage is not run. This allows
+// generated files to be restored rather than regenerated when switching back
+// and forth between branches.
+//
+// The cache is stored in the users cache directory unless overridden by the
+// [CacheDirEnvVar] env variable and is limited in size by the
+// [CacheMaxSizeEnvVar] env variable, evicting the least recently used entries
+// first. The `-force` flag can be given to [Main] to always run the stage,
+// refreshing its cache entry. A remote cache can also be used by setting the
+// [RemoteCacheURLEnvVar] env variable, see [RemoteCacheURLEnvVar] and
+// [RemoteCacheWriteEnvVar] for details.
+func Cached(opts CacheOpts, stage Stager) Stager {
+	names := stage.Names()
+	name := opts.Key
+	if name == "" {
+		name = strings.Join(names, ", ")
+	}
+
+	return wrapStage(func(ctxt context.Context, cmdLineArgs ...string) error {
+		if name == unnamedStage {
+			return errors.New(
+				"Cached stages that wrap an unnamed stage must be given a key",
+			)
+		}
+		c, err := openLocalCache()
+		if err != nil {
+			return err
+		}
+		remote, err := openRemoteCache()
+		if err != nil {
+			return err
+		}
+		key, err := cacheKey(name, opts)
+		if err != nil {
+			return err
+		}
+
+		if inv, ok := getInvocation(ctxt); ok && inv.force {
+			LogInfoContext(ctxt,
+				"Stage '%s': Running because the -force flag was supplied", name,
+			)
+		} else if restoreCached(ctxt, c, remote, name, key) {
+			recordSkippedStages(ctxt, "Restored from cache", names...)
+			return nil
+		}
+
+		if err := stage.Run(ctxt, cmdLineArgs...); err != nil {
+			return err
+		}
+
+		files, err := globFiles(opts.Outputs...)
+		if err != nil {
+			return err
+		}
+		m, err := c.store(key, files)
+		if err != nil {
+			LogWarnContext(ctxt, "Stage '%s': Could not store outputs in cache: %s", name, err)
+			return nil
+		}
+		if remote != nil && remote.write {
+			if err := remote.push(ctxt, c, m); err != nil {
+				LogWarnContext(ctxt,
+					"Stage '%s': Could not store outputs in remote cache: %s",
+					name, err,
+				)
+			}
+		}
+		return nil
+	}, stage)
+}
+
+// Attempts to restore the outputs of the stage with the supplied key, first
+// from the local cache and then from the remote cache if it is enabled.
+// Returns true if the outputs were restored. Failing to restore from either
+// cache is not an error, the stage will simply be run.
+func restoreCached(
+	ctxt context.Context,
+	c *localCache,
+	remote *remoteCache,
+	name string,
+	key string,
+) bool {
+	restored, err := c.restore(key)
+	if err != nil {
+		LogWarnContext(ctxt, "Stage '%s': Could not restore from cache: %s", name, err)
+	} else if restored >= 0 {
+		LogSkipContext(ctxt,
+			"Stage '%s': Restored %d file(s) from cache, skipping",
+			name, restored,
+		)
+		return true
+	}
+
+	if remote != nil {
+		LogQuietInfoContext(ctxt, "Stage '%s': Checking remote cache for key %s", name, key)
+		if ok, err := remote.fetch(ctxt, c, key); err != nil {
+			LogWarnContext(ctxt,
+				"Stage '%s': Could not fetch from remote cache: %s", name, err,
+			)
+		} else if ok {
+			if restored, err = c.restore(key); err != nil {
+				LogWarnContext(ctxt, "Stage '%s': Could not restore from cache: %s", name, err)
+			} else if restored >= 0 {
+				LogSkipContext(ctxt,
+					"Stage '%s': Restored %d file(s) from remote cache, skipping",
+					name, restored,
+				)
+				return true
+			}
+		}
+	}
+
+	LogInfoContext(ctxt, "Stage '%s': No cache entry found for key %s", name, key)
+	return false
+}
+
+// Returns the cache key for the supplied stage, which is a hash of the stages
+// name, the contents of its inputs, its command line, and the values of the
+// selected env variables.
+func cacheKey(name string, opts CacheOpts) (string, error) {
+	inputs, err := hashGlobs(opts.Inputs...)
+	if err != nil {
+		return "", err
+	}
+	files := make([]string, 0, len(inputs))
+	for p := range inputs {
+		files = append(files, p)
+	}
+	slices.Sort(files)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "version\x00%s\x00", cacheVersion)
+	fmt.Fprintf(h, "key\x00%s\x00", name)
+	for _, f := range files {
+		fmt.Fprintf(h, "input\x00%s\x00%s\x00", filepath.ToSlash(f), inputs[f])
+	}
+	for _, arg := range opts.Cmd {
+		fmt.Fprintf(h, "cmd\x00%s\x00", arg)
+	}
+	for _, env := range opts.Env {
+		val, ok := os.LookupEnv(env)
+		fmt.Fprintf(h, "env\x00%s\x00%t\x00%s\x00", env, ok, val)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Opens the local cache, using the env variables to determine its location
+// and maximum size.
+func openLocalCache() (*localCache, error) {
+	c := &localCache{maxSize: defaultCacheMaxSize}
+	if dir, ok := os.LookupEnv(CacheDirEnvVar); ok {
+		c.dir = dir
+	} else {
+		userDir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		c.dir = filepath.Join(userDir, "sbbs")
+	}
+	if size, ok := os.LookupEnv(CacheMaxSizeEnvVar); ok {
+		var err error
+		if c.maxSize, err = parseByteSize(size); err != nil {
+			return nil, fmt.Errorf(
+				"Invalid value for %s: %w", CacheMaxSizeEnvVar, err,
+			)
+		}
+	}
+	return c, nil
+}
+
+// Parses a number of bytes that is optionally followed by a K, M, or G suffix.
+func parseByteSize(size string) (int64, error) {
+	size = strings.ToUpper(strings.TrimSpace(size))
+	mult := int64(1)
+	for suffix, iterMult := range map[string]int64{
+		"K": 1 << 10, "M": 1 << 20, "G": 1 << 30,
+	} {
+		if strings.HasSuffix(size, suffix) {
+			size, mult = strings.TrimSuffix(size, suffix), iterMult
+			break
+		}
+	}
+	rv, err := strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if rv < 0 {
+		return 0, fmt.Errorf("Size must not be negative: %d", rv)
+	}
+	return rv * mult, nil
+}
+
+func (c *localCache) blobPath(hash string) string {
+	return filepath.Join(c.dir, "blobs", hash)
+}
+
+func (c *localCache) entryPath(key string) string {
+	return filepath.Join(c.dir, "entries", key+".json")
+}
+
+// Locks the cache so that no other goroutine or process modifies it until the
+// returned function is called.
+func (c *localCache) lock() (unlock func(), err error) {
+	cacheMu.Lock()
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		cacheMu.Unlock()
+		return nil, err
+	}
+	unlockFile, err := lockFile(filepath.Join(c.dir, "lock"))
+	if err != nil {
+		cacheMu.Unlock()
+		return nil, err
+	}
+	return func() {
+		unlockFile()
+		cacheMu.Unlock()
+	}, nil
+}
+
+// Reads the manifest for the supplied key. A nil manifest is returned if the
+// key is not present in the cache.
+func (c *localCache) manifest(key string) (*cacheManifest, error) {
+	data, err := os.ReadFile(c.entryPath(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var m cacheManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// Restores the files for the supplied key, returning the number of files that
+// were restored. -1 is returned if the key is not present in the cache or if
+// any of the files it references are missing.
+func (c *localCache) restore(key string) (int, error) {
+	unlock, err := c.lock()
+	if err != nil {
+		return -1, err
+	}
+	defer unlock()
+
+	m, err := c.manifest(key)
+	if err != nil || m == nil {
+		return -1, err
+	}
+	for _, f := range m.Files {
+		if !c.hasBlob(f.Hash) {
+			return -1, nil
+		}
+	}
+	for _, f := range m.Files {
+		if err := copyFile(c.blobPath(f.Hash), f.Path, f.Mode); err != nil {
+			return -1, err
+		}
+	}
+
+	now := time.Now()
+	return len(m.Files), os.Chtimes(c.entryPath(key), now, now)
+}
+
+// Stores the supplied files in the cache under the supplied key and then
+// evicts the least recently used entries until the cache is within its
+// maximum size. The manifest of the new entry is returned.
+func (c *localCache) store(key string, files []string) (cacheManifest, error) {
+	m := cacheManifest{Key: key, Files: make([]cacheFile, len(files))}
+	temps := map[string]string{}
+	defer removeTemps(temps)
+	for i, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return m, err
+		}
+		in, err := os.Open(f)
+		if err != nil {
+			return m, err
+		}
+		tmp, hash, err := c.writeTemp(in)
+		in.Close()
+		if err != nil {
+			return m, err
+		}
+		if _, ok := temps[hash]; ok {
+			os.Remove(tmp)
+		} else {
+			temps[hash] = tmp
+		}
+		m.Files[i] = cacheFile{Path: f, Hash: hash, Mode: info.Mode().Perm()}
+	}
+	return m, c.commit(m, temps)
+}
+
+// Adds the supplied manifest to the cache, moving the temporary files it
+// references into the blobs directory, and then evicts the least recently
+// used entries until the cache is within its maximum size. The supplied temps
+// map the hash of a file to the temporary file that contains it, see
+// [localCache.writeTemp]. Everything is done while the cache is locked so
+// that the blobs cannot be evicted before the manifest that references them
+// is written. An error is returned if any other blob the manifest references
+// is not present in the cache.
+func (c *localCache) commit(m cacheManifest, temps map[string]string) error {
+	unlock, err := c.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for _, f := range m.Files {
+		tmp, ok := temps[f.Hash]
+		switch {
+		case ok && c.hasBlob(f.Hash):
+			os.Remove(tmp)
+		case ok:
+			if err := os.MkdirAll(filepath.Join(c.dir, "blobs"), 0755); err != nil {
+				return err
+			}
+			if err := os.Rename(tmp, c.blobPath(f.Hash)); err != nil {
+				return err
+			}
+		case !c.hasBlob(f.Hash):
+			return fmt.Errorf("Blob is missing from the cache: %s", f.Hash)
+		}
+	}
+
+	data, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(c.entryPath(m.Key), data); err != nil {
+		return err
+	}
+	return c.evict()
+}
+
+// Returns true if a blob with the supplied hash is present in the cache.
+func (c *localCache) hasBlob(hash string) bool {
+	_, err := os.Stat(c.blobPath(hash))
+	return err == nil
+}
+
+// Copies the supplied data into a new temporary file in the cache, returning
+// the path of the file and the hash of its contents. Temporary files are never
+// evicted, they must be added to the cache with [localCache.commit] or be
+// removed by the caller.
+func (c *localCache) writeTemp(data io.Reader) (string, string, error) {
+	if err := os.MkdirAll(filepath.Join(c.dir, "tmp"), 0755); err != nil {
+		return "", "", err
+	}
+	out, err := os.CreateTemp(filepath.Join(c.dir, "tmp"), "blob-*")
+	if err != nil {
+		return "", "", err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, h), data)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return "", "", err
+	}
+	return out.Name(), hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Removes the supplied temporary files, ignoring any that have already been
+// moved into the cache.
+func removeTemps(temps map[string]string) {
+	for _, tmp := range temps {
+		os.Remove(tmp)
+	}
+}
+
+// Removes every entry and blob from the cache.
+func (c *localCache) clean() error {
+	unlock, err := c.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	for _, dir := range []string{"entries", "blobs", "tmp"} {
+		if err := os.RemoveAll(filepath.Join(c.dir, dir)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the manifests of every entry in the cache, ordered from least to
+// most recently used.
+func (c *localCache) entries() ([]fs.FileInfo, error) {
+	dirEntries, err := os.ReadDir(filepath.Join(c.dir, "entries"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	rv := make([]fs.FileInfo, 0, len(dirEntries))
+	for _, e := range dirEntries {
+		if info, err := e.Info(); err == nil && !e.IsDir() {
+			rv = append(rv, info)
+		}
+	}
+	slices.SortFunc(rv, func(l, r fs.FileInfo) int {
+		return l.ModTime().Compare(r.ModTime())
+	})
+	return rv, nil
+}
+
+// Removes the least recently used entries until the size of the cache is at
+// or below its maximum size. Blobs that are no longer referenced by any entry
+// are removed.
+func (c *localCache) evict() error {
+	entries, err := c.entries()
+	if err != nil {
+		return err
+	}
+
+	// Walk the entries from most to least recently used, keeping entries
+	// until the maximum size is reached. A blob is only counted once, by the
+	// most recently used entry that references it.
+	var size int64
+	keep := map[string]struct{}{}
+	for i := len(entries) - 1; i >= 0; i-- {
+		key := strings.TrimSuffix(entries[i].Name(), ".json")
+		m, err := c.manifest(key)
+		if err != nil || m == nil {
+			continue
+		}
+
+		entrySize := entries[i].Size()
+		newBlobs := []string{}
+		for _, f := range m.Files {
+			if _, ok := keep[f.Hash]; ok || slices.Contains(newBlobs, f.Hash) {
+				continue
+			}
+			if info, err := os.Stat(c.blobPath(f.Hash)); err == nil {
+				entrySize += info.Size()
+			}
+			newBlobs = append(newBlobs, f.Hash)
+		}
+
+		if size+entrySize > c.maxSize {
+			LogQuietInfo("Evicting cache entry: %s", key)
+			if err := os.Remove(c.entryPath(key)); err != nil {
+				return err
+			}
+			continue
+		}
+		size += entrySize
+		for _, b := range newBlobs {
+			keep[b] = struct{}{}
+		}
+	}
+
+	blobs, err := os.ReadDir(filepath.Join(c.dir, "blobs"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, b := range blobs {
+		if _, ok := keep[b.Name()]; !ok {
+			if err := os.Remove(c.blobPath(b.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Returns statistics describing the contents of the cache.
+func (c *localCache) stats() (cacheStats, error) {
+	var rv cacheStats
+	entries, err := c.entries()
+	if err != nil {
+		return rv, err
+	}
+	rv.entries = len(entries)
+	for _, e := range entries {
+		rv.size += e.Size()
+	}
+
+	blobs, err := os.ReadDir(filepath.Join(c.dir, "blobs"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return rv, err
+	}
+	for _, b := range blobs {
+		if info, err := b.Info(); err == nil {
+			rv.blobs++
+			rv.size += info.Size()
+		}
+	}
+	return rv, nil
+}
+
+// Copies the supplied file to the destination, creating any parent
+// directories and setting the destinations permissions to the supplied mode.
+func copyFile(src string, dst string, mode fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chmod(dst, mode)
+}
+
+// Writes the supplied data to a temporary file and then renames it to the
+// supplied name so that readers never see a partially written file.
+func writeFileAtomic(name string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// Formats the supplied number of bytes in a human readable form.
+func formatByteSize(size int64) string {
+	switch {
+	case size >= 1<<30:
+		return fmt.Sprintf("%.2fGiB", float64(size)/(1<<30))
+	case size >= 1<<20:
+		return fmt.Sprintf("%.2fMiB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.2fKiB", float64(size)/(1<<10))
+	default:
+		return fmt.Sprintf("%dB", size)
+	}
+}
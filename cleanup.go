@@ -0,0 +1,109 @@
+package sbbs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+)
+
+type (
+	// The cleanup functions that have been registered while a stage or target
+	// was running. See [AddCleanup].
+	cleanupScope struct {
+		mu  sync.Mutex
+		fns []func() error
+	}
+
+	cleanupScopeKey struct{}
+)
+
+// Returns a context that any cleanup functions registered with [AddCleanup]
+// will be added to, along with the scope that holds them. The scope must be
+// run once the operation that was given the context has returned.
+func withCleanupScope(ctxt context.Context) (context.Context, *cleanupScope) {
+	scope := &cleanupScope{}
+	return context.WithValue(ctxt, cleanupScopeKey{}, scope), scope
+}
+
+// Runs all of the cleanup functions in the reverse order they were added,
+// returning all of the errors that were encountered. Every cleanup function is
+// run even if an earlier one fails.
+func (s *cleanupScope) run() error {
+	s.mu.Lock()
+	fns := s.fns
+	s.fns = nil
+	s.mu.Unlock()
+
+	var errs []error
+	for i := len(fns) - 1; i >= 0; i-- {
+		if err := fns[i](); err != nil {
+			LogErr("A cleanup function encountered an error: %s", err)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Registers a function that will be run once the current stage finishes,
+// regardless of whether it succeeded, failed, or was cancelled. Cleanup
+// functions are run in the reverse order they were added, much like defer. If
+// the supplied context was not given to a stage created with [Stage] the
+// function will be run once the current target finishes instead. An error is
+// returned if the supplied context was not given to a stage by the build
+// system.
+func AddCleanup(ctxt context.Context, fn func() error) error {
+	scope, err := getCleanupScope(ctxt)
+	if err != nil {
+		return err
+	}
+	scope.mu.Lock()
+	defer scope.mu.Unlock()
+	scope.fns = append(scope.fns, fn)
+	return nil
+}
+
+func getCleanupScope(ctxt context.Context) (*cleanupScope, error) {
+	scope, ok := ctxt.Value(cleanupScopeKey{}).(*cleanupScope)
+	if !ok {
+		return nil, errors.New(
+			"Cleanup functions can only be added from within a running stage",
+		)
+	}
+	return scope, nil
+}
+
+// Sets the supplied env variable to the supplied value until the current stage
+// finishes, at which point the env variable is restored to its original value.
+// See [TmpEnvVarSet] and [AddCleanup]. This changes the environment of the
+// entire process, so [Command.Env] should be preferred when the env variable
+// is only needed by a single command.
+func ScopedEnvVarSet(ctxt context.Context, name string, val string) error {
+	// The scope is checked first so that nothing is changed if it cannot
+	// be undone.
+	if _, err := getCleanupScope(ctxt); err != nil {
+		return err
+	}
+	reset, err := TmpEnvVarSet(name, val)
+	if err != nil {
+		return err
+	}
+	return AddCleanup(ctxt, reset)
+}
+
+// Changes the current working directory to the supplied directory until the
+// current stage finishes, at which point the original working directory is
+// restored. See [Cd] and [AddCleanup].
+func ScopedCd(ctxt context.Context, dir string) error {
+	if _, err := getCleanupScope(ctxt); err != nil {
+		return err
+	}
+	old, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if err := Cd(dir); err != nil {
+		return err
+	}
+	return AddCleanup(ctxt, func() error { return Cd(old) })
+}
@@ -0,0 +1,101 @@
+package sbbs
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// Disables colored output when set to any non-empty value, unless color
+	// was forced with [ForceColorEnvVar] or the `-color` flag. See
+	// https://no-color.org.
+	NoColorEnvVar = "NO_COLOR"
+	// Enables colored output, even when stderr is not a terminal, when set to
+	// any value other than an empty string, 0, or false.
+	ForceColorEnvVar = "FORCE_COLOR"
+)
+
+// Controls when log messages are colored. See [SetColorMode].
+type ColorMode int
+
+const (
+	// Color is used when stderr is a terminal, unless disabled with the
+	// [NoColorEnvVar] env variable or forced with the [ForceColorEnvVar] env
+	// variable. This is the default.
+	ColorAuto ColorMode = iota
+	// Color is always used.
+	ColorAlways
+	// Color is never used.
+	ColorNever
+)
+
+var colorEnabled atomic.Bool
+
+func init() {
+	SetColorMode(ColorAuto)
+}
+
+func (c ColorMode) String() string {
+	switch c {
+	case ColorAuto:
+		return "auto"
+	case ColorAlways:
+		return "always"
+	case ColorNever:
+		return "never"
+	}
+	return fmt.Sprintf("ColorMode(%d)", int(c))
+}
+
+// Parses a color mode from its name, which is one of auto, always, or never.
+// Case is ignored.
+func ParseColorMode(name string) (ColorMode, error) {
+	for _, c := range []ColorMode{ColorAuto, ColorAlways, ColorNever} {
+		if strings.EqualFold(name, c.String()) {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf(
+		"Invalid color mode '%s', expected one of: auto, always, never", name,
+	)
+}
+
+// Sets when log messages, and the prefixes added to the output of concurrently
+// running stages, are colored.
+func SetColorMode(mode ColorMode) {
+	switch mode {
+	case ColorAlways:
+		colorEnabled.Store(true)
+	case ColorNever:
+		colorEnabled.Store(false)
+	default:
+		colorEnabled.Store(detectColor())
+	}
+}
+
+// Determines if color should be used based on the env variables and whether
+// stderr, which is where all log messages are written, is a terminal.
+func detectColor() bool {
+	if force := os.Getenv(ForceColorEnvVar); force != "" {
+		if enabled, err := strconv.ParseBool(force); err != nil || enabled {
+			return true
+		}
+		return false
+	}
+	if os.Getenv(NoColorEnvVar) != "" {
+		return false
+	}
+	info, err := os.Stderr.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Wraps the supplied string in the supplied color code if color is enabled.
+func colorize(color string, s string) string {
+	if !colorEnabled.Load() {
+		return s
+	}
+	return color + s + noColor
+}
@@ -0,0 +1,371 @@
+package sbbs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a program is given to exit after being asked to stop when its
+// context is cancelled. Once the grace period has passed the program, and any
+// processes it started, are killed.
+var CancelGracePeriod = 5 * time.Second
+
+// The number of lines from the end of a failed commands stderr that are
+// included in the returned [CmdError].
+const stderrTailLines = 20
+
+// Controls where a commands stderr is written. See [Command.Stderr].
+type StderrMode int
+
+const (
+	// Stderr is printed to the console and captured in the [CmdResult]. This
+	// is the default.
+	StderrTee StderrMode = iota
+	// Stderr is only printed to the console.
+	StderrConsole
+	// Stderr is only captured in the [CmdResult], which is useful for
+	// inspecting errors from a program without printing them.
+	StderrCapture
+	// Stderr is neither printed nor captured, which is useful for silencing
+	// noisy programs.
+	StderrDiscard
+	// Stderr is written to the same places as stdout and is captured as part
+	// of the commands stdout, as though the program was run with `2>&1`.
+	StderrMerge
+)
+
+type (
+	// A program that can be run by a stage. Commands are created with [Cmd]
+	// and configured by chaining the methods defined on this type before
+	// calling [Command.Run].
+	Command struct {
+		prog        string
+		args        []string
+		dir         string
+		env         []envChange
+		stdin       func() (io.Reader, func() error, error)
+		stdout      io.Writer
+		stderrMode  StderrMode
+		okExitCodes []int
+	}
+
+	// A change to a commands environment. When unset is true the env variable
+	// is removed, otherwise it is set to the value.
+	envChange struct {
+		name  string
+		val   string
+		unset bool
+	}
+
+	// The result of running a [Command].
+	CmdResult struct {
+		// The command line that was run, including the resolved path of the
+		// program.
+		Cmdline string
+		// The exit code of the program. This will be -1 if the program could
+		// not be started or was killed by a signal.
+		ExitCode int
+		// Everything the program wrote to stdout.
+		Stdout []byte
+		// Everything the program wrote to stderr.
+		Stderr []byte
+		// Everything the program wrote to stdout and stderr, in the order it
+		// was received. Stdout and stderr are read separately, so output
+		// written to both at nearly the same time may be slightly reordered.
+		Combined []byte
+		// How long the program ran for.
+		Duration time.Duration
+	}
+
+	// The error that is returned when a command fails to start or exits with
+	// an exit code that was not considered successful. The wrapped error is
+	// the error returned by the [os/exec] package, so [exec.ExitError] can be
+	// used with [errors.As].
+	CmdError struct {
+		Cmdline  string
+		ExitCode int
+		Err      error
+		// The last lines the command wrote to stderr, if stderr was captured.
+		// These are included in the errors message so that the reason a
+		// command failed is shown alongside the failure.
+		StderrTail string
+	}
+
+	// A writer that is safe to use from multiple goroutines, allowing stdout
+	// and stderr to be written to the same buffer.
+	lockedBuffer struct {
+		mu  sync.Mutex
+		buf bytes.Buffer
+	}
+)
+
+func (c CmdError) Error() string {
+	if c.StderrTail == "" {
+		return fmt.Sprintf("'%s': %s", c.Cmdline, c.Err)
+	}
+	return fmt.Sprintf("'%s': %s\nStderr:\n%s", c.Cmdline, c.Err, c.StderrTail)
+}
+
+func (c CmdError) Unwrap() error {
+	return c.Err
+}
+
+func (l *lockedBuffer) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(p)
+}
+
+// Creates a command that will run the supplied program with the supplied args.
+// By default the command is run in the current working directory, its stdout
+// is only captured, its stderr is both captured and printed to the console,
+// and only an exit code of zero is considered successful. If the command fails
+// the end of its captured stderr is included in the returned error.
+func Cmd(prog string, args ...string) *Command {
+	return &Command{prog: prog, args: args, okExitCodes: []int{0}}
+}
+
+// Sets the directory the command will be run in. An empty string means the
+// current working directory.
+func (c *Command) Dir(dir string) *Command {
+	c.dir = dir
+	return c
+}
+
+// Sets where the commands stderr is written. See [StderrMode] for the available
+// options.
+func (c *Command) Stderr(mode StderrMode) *Command {
+	c.stderrMode = mode
+	return c
+}
+
+// Sets the supplied env variable to the supplied value for only this command,
+// overriding the value that would otherwise be inherited from the current
+// process. Unlike [TmpEnvVarSet] this does not modify the current processes
+// environment, so it is safe to use when commands are run concurrently.
+func (c *Command) Env(name string, val string) *Command {
+	c.env = append(c.env, envChange{name: name, val: val})
+	return c
+}
+
+// Removes the supplied env variables from the environment the command would
+// otherwise inherit from the current process.
+func (c *Command) UnsetEnv(names ...string) *Command {
+	for _, name := range names {
+		c.env = append(c.env, envChange{name: name, unset: true})
+	}
+	return c
+}
+
+// Sets the reader the command will read stdin from. By default the command
+// reads from the null device. On unix systems commands are run in their own
+// process group, see [Command.Run], except for commands that read stdin from a
+// terminal, such as when [os.Stdin] is supplied and the build system was run
+// from a terminal. Those commands stay in the build systems process group so
+// that they are not stopped when reading from the terminal, which means that
+// any processes they start are not stopped when the command is cancelled.
+func (c *Command) Stdin(r io.Reader) *Command {
+	c.stdin = func() (io.Reader, func() error, error) {
+		return r, func() error { return nil }, nil
+	}
+	return c
+}
+
+// Sets the command to read stdin from the supplied string.
+func (c *Command) StdinString(s string) *Command {
+	return c.Stdin(strings.NewReader(s))
+}
+
+// Sets the command to read stdin from the supplied file. The file is opened
+// when the command is run and closed once it exits.
+func (c *Command) StdinFile(name string) *Command {
+	c.stdin = func() (io.Reader, func() error, error) {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		return f, f.Close, nil
+	}
+	return c
+}
+
+// Returns the environment the command should be run with. Nil is returned if
+// there are no changes so that the command inherits the current processes
+// environment.
+func (c *Command) environ() []string {
+	if len(c.env) == 0 {
+		return nil
+	}
+	rv := os.Environ()
+	for _, change := range c.env {
+		rv = slices.DeleteFunc(rv, func(kv string) bool {
+			return strings.HasPrefix(kv, change.name+"=")
+		})
+		if !change.unset {
+			rv = append(rv, change.name+"="+change.val)
+		}
+	}
+	return rv
+}
+
+// Sets a writer that will receive the commands stdout as it is written, in
+// addition to the stdout being captured in the [CmdResult].
+func (c *Command) Stdout(w io.Writer) *Command {
+	c.stdout = w
+	return c
+}
+
+// Sets additional exit codes that are considered successful, along with zero.
+// This is useful for programs that use non-zero exit codes to report something
+// other than a failure, such as `grep` exiting with 1 when nothing matched.
+func (c *Command) OkExitCodes(codes ...int) *Command {
+	c.okExitCodes = append(c.okExitCodes, codes...)
+	return c
+}
+
+// Runs the command using the supplied context. If the context is cancelled the
+// program is asked to stop, and is killed if it does not stop within the
+// [CancelGracePeriod]. On unix systems the program is run in its own process
+// group so that any processes it starts are stopped along with it. The
+// returned result is never nil, even when an error is returned, so that the
+// output of a failed command can be inspected.
+func (c *Command) Run(ctxt context.Context) (*CmdResult, error) {
+	res, err := c.run(ctxt)
+	recordCommand(ctxt, res, err)
+	return res, err
+}
+
+func (c *Command) run(ctxt context.Context) (*CmdResult, error) {
+	var stdout, stderr bytes.Buffer
+	var combined lockedBuffer
+
+	rv := &CmdResult{ExitCode: -1}
+	cmd := exec.CommandContext(ctxt, c.prog, c.args...)
+	cmd.Dir = c.dir
+	cmd.Env = c.environ()
+	if c.stdin != nil {
+		stdin, closeStdin, err := c.stdin()
+		if err != nil {
+			rv.Cmdline = cmd.String()
+			return rv, CmdError{Cmdline: rv.Cmdline, ExitCode: -1, Err: err}
+		}
+		defer closeStdin()
+		cmd.Stdin = stdin
+	}
+	// Output that is written to the console goes through the stages output
+	// so that it is line buffered and prefixed when stages run concurrently.
+	consoleStdout := consoleWriter(ctxt, os.Stdout)
+	defer consoleStdout.Close()
+	consoleStderr := consoleWriter(ctxt, os.Stderr)
+	defer consoleStderr.Close()
+
+	cmd.Stdout = io.MultiWriter(&stdout, &combined)
+	if c.stdout == os.Stdout {
+		cmd.Stdout = io.MultiWriter(cmd.Stdout, consoleStdout)
+	} else if c.stdout != nil {
+		cmd.Stdout = io.MultiWriter(cmd.Stdout, c.stdout)
+	}
+	switch c.stderrMode {
+	case StderrTee:
+		cmd.Stderr = io.MultiWriter(&stderr, &combined, consoleStderr)
+	case StderrConsole:
+		cmd.Stderr = io.MultiWriter(&combined, consoleStderr)
+	case StderrCapture:
+		cmd.Stderr = io.MultiWriter(&stderr, &combined)
+	case StderrDiscard:
+		cmd.Stderr = io.Discard
+	case StderrMerge:
+		cmd.Stderr = cmd.Stdout
+	}
+	cmd.WaitDelay = CancelGracePeriod
+	stopKill := setCancelSignals(cmd)
+	defer stopKill()
+
+	LogQuietInfoContext(ctxt, "Running: '%s'", cmd.String())
+	for _, change := range c.env {
+		if change.unset {
+			LogQuietInfoContext(ctxt, multiLineIndent+"Env: unset %s", change.name)
+		} else {
+			LogQuietInfoContext(ctxt, multiLineIndent+"Env: %s=%s", change.name, change.val)
+		}
+	}
+	if c.dir != "" {
+		LogQuietInfoContext(ctxt, multiLineIndent+"Dir: %s", c.dir)
+	}
+	start := time.Now()
+	err := cmd.Start()
+	if err == nil {
+		untrack := trackCmd(cmd)
+		err = cmd.Wait()
+		untrack()
+	}
+	rv.Cmdline = cmd.String()
+	rv.Stdout = stdout.Bytes()
+	rv.Stderr = stderr.Bytes()
+	rv.Combined = combined.buf.Bytes()
+	rv.Duration = time.Since(start)
+	if cmd.ProcessState != nil {
+		rv.ExitCode = cmd.ProcessState.ExitCode()
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	case err != nil && ctxt.Err() != nil:
+		return rv, context.Cause(ctxt)
+	case errors.As(err, &exitErr) && slices.Contains(c.okExitCodes, rv.ExitCode):
+		return rv, nil
+	case err != nil:
+		captured := rv.Stderr
+		if c.stderrMode == StderrMerge {
+			captured = rv.Stdout
+		}
+		return rv, CmdError{
+			Cmdline:    rv.Cmdline,
+			ExitCode:   rv.ExitCode,
+			Err:        err,
+			StderrTail: tailLines(captured, stderrTailLines),
+		}
+	}
+	return rv, nil
+}
+
+// Returns the last n lines of the supplied output, ignoring trailing new lines.
+func tailLines(output []byte, n int) string {
+	lines := strings.Split(strings.TrimRight(string(output), " \t\r\n"), "\n")
+	if len(lines) > n {
+		lines = append([]string{"..."}, lines[len(lines)-n:]...)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Returns everything the command wrote to stdout.
+func (r *CmdResult) Output() string {
+	return string(r.Stdout)
+}
+
+// Returns everything the command wrote to stdout with any leading and trailing
+// white space removed.
+func (r *CmdResult) TrimmedOutput() string {
+	return strings.TrimSpace(string(r.Stdout))
+}
+
+// Returns the lines the command wrote to stdout. Trailing white space is
+// removed from each line and empty lines are skipped.
+func (r *CmdResult) Lines() []string {
+	rv := []string{}
+	for _, line := range strings.Split(string(r.Stdout), "\n") {
+		if line = strings.TrimRight(line, " \t\r"); line != "" {
+			rv = append(rv, line)
+		}
+	}
+	return rv
+}
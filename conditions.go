@@ -0,0 +1,202 @@
+package sbbs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+)
+
+type (
+	// A condition that decides if a stage or target should be run. See [When]
+	// and [Target.When].
+	Condition struct {
+		// Describes what must be true for the condition to be met, such as
+		// "env variable 'CI' is set". This is logged when a stage or target is
+		// skipped because the condition was not met.
+		Desc string
+		// Returns true if the condition is met. Any error that is returned
+		// will fail the stage or target the condition was applied to.
+		Check func(ctxt context.Context) (bool, error)
+	}
+
+	targetRunKey struct{}
+)
+
+// Creates a stage that only runs the supplied stage if the supplied condition
+// is met. When the condition is not met the stage is logged as skipped, rather
+// than as having completed successfully, and is listed as skipped in the
+// summary that is printed when running multiple targets.
+func When(cond Condition, stage Stager) Stager {
+	names := stage.Names()
+	return wrapStage(func(ctxt context.Context, cmdLineArgs ...string) error {
+		ok, err := cond.Check(ctxt)
+		if err != nil {
+			return fmt.Errorf("Could not check if %s: %w", cond.Desc, err)
+		}
+		if ok {
+			return stage.Run(ctxt, cmdLineArgs...)
+		}
+
+		for _, name := range names {
+			LogSkipContext(ctxt, "Stage '%s': Skipped, condition not met: %s", name, cond.Desc)
+		}
+		recordSkippedStages(ctxt, cond.Desc, names...)
+		return nil
+	}, stage)
+}
+
+// Records that the named stages were skipped for the supplied reason, adding
+// them to the report of the target that is running them and to the stages the
+// summary lists as skipped.
+func recordSkippedStages(ctxt context.Context, reason string, names ...string) {
+	for _, name := range names {
+		if report := recordStage(ctxt, name, time.Now()); report != nil {
+			report.SkipReason = reason
+			report.finish(ctxt, reportSkipped, nil)
+		}
+	}
+	if r, ok := ctxt.Value(targetRunKey{}).(*targetRun); ok {
+		if inv, ok := getInvocation(ctxt); ok {
+			inv.mu.Lock()
+			r.skippedStages = append(r.skippedStages, names...)
+			inv.mu.Unlock()
+		}
+	}
+}
+
+// Adds a condition that must be met for the targets stages to be run. If any
+// of the targets conditions are not met the target is logged as skipped and
+// treated as though it succeeded, so targets that depend on it will still be
+// run. The targets dependencies are always run because they are run before
+// the conditions are checked.
+func (t *Target) When(cond Condition) *Target {
+	t.conds = append(t.conds, cond)
+	return t
+}
+
+// Returns the first of the targets conditions that is not met, if any.
+func (t *Target) unmetCondition(ctxt context.Context) (*Condition, error) {
+	for i, cond := range t.conds {
+		ok, err := cond.Check(ctxt)
+		if err != nil {
+			return nil, fmt.Errorf("Could not check if %s: %w", cond.Desc, err)
+		}
+		if !ok {
+			return &t.conds[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// A condition that is met when the supplied condition is not met.
+func Not(cond Condition) Condition {
+	return Condition{
+		Desc: fmt.Sprintf("NOT(%s)", cond.Desc),
+		Check: func(ctxt context.Context) (bool, error) {
+			ok, err := cond.Check(ctxt)
+			return !ok, err
+		},
+	}
+}
+
+// A condition that is met when the supplied env variable is set to a non-empty
+// value. For example, `EnvSet("CI")` can be used to only run a stage in CI.
+func EnvSet(name string) Condition {
+	return Condition{
+		Desc: fmt.Sprintf("env variable '%s' is set", name),
+		Check: func(ctxt context.Context) (bool, error) {
+			return os.Getenv(name) != "", nil
+		},
+	}
+}
+
+// A condition that is met when the build system is running on one of the
+// supplied operating systems, as reported by [runtime.GOOS].
+func OnOS(goos ...string) Condition {
+	return Condition{
+		Desc: fmt.Sprintf("GOOS is one of %v", goos),
+		Check: func(ctxt context.Context) (bool, error) {
+			return slices.Contains(goos, runtime.GOOS), nil
+		},
+	}
+}
+
+// A condition that is met when the build system is running on one of the
+// supplied architectures, as reported by [runtime.GOARCH].
+func OnArch(goarch ...string) Condition {
+	return Condition{
+		Desc: fmt.Sprintf("GOARCH is one of %v", goarch),
+		Check: func(ctxt context.Context) (bool, error) {
+			return slices.Contains(goarch, runtime.GOARCH), nil
+		},
+	}
+}
+
+// A condition that is met when the supplied path exists. The path is relative
+// to the current working directory when the condition is checked.
+func FileExists(path string) Condition {
+	return Condition{
+		Desc: fmt.Sprintf("'%s' exists", path),
+		Check: func(ctxt context.Context) (bool, error) {
+			_, err := os.Stat(path)
+			if errors.Is(err, fs.ErrNotExist) {
+				return false, nil
+			}
+			return err == nil, err
+		},
+	}
+}
+
+// A condition that is met when the supplied program can be found in any of the
+// directories listed in the PATH env variable.
+func ToolOnPath(prog string) Condition {
+	return Condition{
+		Desc: fmt.Sprintf("'%s' is on the PATH", prog),
+		Check: func(ctxt context.Context) (bool, error) {
+			_, err := exec.LookPath(prog)
+			return err == nil, nil
+		},
+	}
+}
+
+// A condition that is met when any file matching the supplied git pathspecs
+// has changed since the point where the current branch diverged from the
+// supplied ref. Uncommitted changes to tracked files are included. For
+// example, `ChangedSince("origin/main", "sql/")` can be used to only run a
+// stage when files under sql/ changed on the current branch.
+func ChangedSince(ref string, pathspecs ...string) Condition {
+	what := "files"
+	if len(pathspecs) > 0 {
+		what = strings.Join(pathspecs, ", ")
+	}
+	return Condition{
+		Desc: fmt.Sprintf("%s changed since %s", what, ref),
+		Check: func(ctxt context.Context) (bool, error) {
+			var base bytes.Buffer
+			if err := Run(
+				ctxt, &base, "git", "merge-base", ref, "HEAD",
+			); err != nil {
+				return false, err
+			}
+
+			var changed bytes.Buffer
+			args := []string{
+				"diff", "--name-only", strings.TrimSpace(base.String()), "--",
+			}
+			if err := Run(
+				ctxt, &changed, "git", append(args, pathspecs...)...,
+			); err != nil {
+				return false, err
+			}
+			return strings.TrimSpace(changed.String()) != "", nil
+		},
+	}
+}
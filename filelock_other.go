@@ -0,0 +1,10 @@
+//go:build !unix
+
+package sbbs
+
+// File locks are only supported on unix systems, so on other platforms the
+// file is not locked and processes that share it are not guarded from each
+// other.
+func lockFile(name string) (unlock func(), err error) {
+	return func() {}, nil
+}
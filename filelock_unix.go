@@ -0,0 +1,26 @@
+//go:build unix
+
+package sbbs
+
+import (
+	"os"
+	"syscall"
+)
+
+// Takes an exclusive lock on the supplied file, creating it if needed, and
+// blocks until the lock is acquired. The lock is held until the returned
+// function is called.
+func lockFile(name string) (unlock func(), err error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
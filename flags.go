@@ -0,0 +1,218 @@
+package sbbs
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+type (
+	// A flag that a target accepts on the cmd line. The define function adds
+	// the flag to the supplied flag set, returning a function that will get
+	// the flags value once the flag set has been parsed.
+	targetFlag struct {
+		name   string
+		define func(fs *flag.FlagSet) func() any
+	}
+
+	// The result of parsing the cmd line arguments that were given to a
+	// target. Flags holds the value of every flag the target declared and
+	// args holds the remaining positional arguments.
+	targetArgs struct {
+		flags map[string]any
+		args  []string
+	}
+
+	// A flag value that can be supplied multiple times, collecting every value
+	// that was supplied.
+	stringsFlag []string
+
+	flagValuesKey struct{}
+)
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(val string) error {
+	*s = append(*s, val)
+	return nil
+}
+
+// Adds the supplied flag to the target, recording a registration error if a
+// flag with the same name has already been added.
+func (t *Target) addFlag(f targetFlag) *Target {
+	for _, iterFlag := range t.flags {
+		if iterFlag.name == f.name {
+			t.bs.registrationErrs = append(
+				t.bs.registrationErrs,
+				fmt.Errorf(
+					"Duplicate flag name for target '%s': %s", t.name, f.name,
+				),
+			)
+			return t
+		}
+	}
+	t.flags = append(t.flags, f)
+	return t
+}
+
+// Declares a string flag that the target accepts. The flags value can be
+// retrieved from within a stage with [StringFlagValue].
+func (t *Target) StringFlag(name string, def string, usage string) *Target {
+	return t.addFlag(targetFlag{
+		name: name,
+		define: func(fs *flag.FlagSet) func() any {
+			p := fs.String(name, def, usage)
+			return func() any { return *p }
+		},
+	})
+}
+
+// Declares a bool flag that the target accepts. The flags value can be
+// retrieved from within a stage with [BoolFlagValue].
+func (t *Target) BoolFlag(name string, def bool, usage string) *Target {
+	return t.addFlag(targetFlag{
+		name: name,
+		define: func(fs *flag.FlagSet) func() any {
+			p := fs.Bool(name, def, usage)
+			return func() any { return *p }
+		},
+	})
+}
+
+// Declares an int flag that the target accepts. The flags value can be
+// retrieved from within a stage with [IntFlagValue].
+func (t *Target) IntFlag(name string, def int, usage string) *Target {
+	return t.addFlag(targetFlag{
+		name: name,
+		define: func(fs *flag.FlagSet) func() any {
+			p := fs.Int(name, def, usage)
+			return func() any { return *p }
+		},
+	})
+}
+
+// Declares a duration flag that the target accepts. The flags value can be
+// retrieved from within a stage with [DurationFlagValue].
+func (t *Target) DurationFlag(
+	name string,
+	def time.Duration,
+	usage string,
+) *Target {
+	return t.addFlag(targetFlag{
+		name: name,
+		define: func(fs *flag.FlagSet) func() any {
+			p := fs.Duration(name, def, usage)
+			return func() any { return *p }
+		},
+	})
+}
+
+// Declares a string flag that the target accepts and that can be supplied
+// multiple times. The flags values can be retrieved from within a stage with
+// [StringsFlagValue].
+func (t *Target) StringsFlag(name string, usage string) *Target {
+	return t.addFlag(targetFlag{
+		name: name,
+		define: func(fs *flag.FlagSet) func() any {
+			var s stringsFlag
+			fs.Var(&s, name, usage+" (can be repeated)")
+			return func() any { return []string(s) }
+		},
+	})
+}
+
+// Creates a flag set containing all of the flags the target declared. The
+// returned map contains the functions that get each flags value.
+func (t *Target) flagSet() (*flag.FlagSet, map[string]func() any) {
+	fs := flag.NewFlagSet(t.name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	getters := make(map[string]func() any, len(t.flags))
+	for _, f := range t.flags {
+		getters[f.name] = f.define(fs)
+	}
+	return fs, getters
+}
+
+// Parses the supplied cmd line arguments using the flags the target declared.
+// If the target did not declare any flags the arguments are left unparsed so
+// that the targets stages can parse them.
+func (t *Target) parseArgs(cmdLineArgs []string) (targetArgs, error) {
+	if len(t.flags) == 0 {
+		return targetArgs{args: cmdLineArgs}, nil
+	}
+
+	fs, getters := t.flagSet()
+	if err := fs.Parse(cmdLineArgs); err != nil {
+		return targetArgs{}, err
+	}
+	rv := targetArgs{flags: make(map[string]any, len(getters)), args: fs.Args()}
+	for name, get := range getters {
+		rv.flags[name] = get()
+	}
+	return rv, nil
+}
+
+// Returns a row for each of the targets flags that can be given to
+// [logTable].
+func (t *Target) flagRows() []string {
+	fs, _ := t.flagSet()
+	rows := []string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		typeName, usage := flag.UnquoteUsage(f)
+		switch f.DefValue {
+		case "", "false", "0", "0s":
+		default:
+			usage += fmt.Sprintf(" (default %s)", f.DefValue)
+		}
+		rows = append(rows, strings.TrimSpace("-"+f.Name+" "+typeName)+"\t"+usage)
+	})
+	return rows
+}
+
+func flagValue[T any](ctxt context.Context, name string) T {
+	var rv T
+	if flags, ok := ctxt.Value(flagValuesKey{}).(map[string]any); ok {
+		rv, _ = flags[name].(T)
+	}
+	return rv
+}
+
+// Returns the value of the supplied string flag for the target that is running
+// the stage the context was given to. The zero value is returned if the target
+// did not declare the flag.
+func StringFlagValue(ctxt context.Context, name string) string {
+	return flagValue[string](ctxt, name)
+}
+
+// Returns the value of the supplied bool flag for the target that is running
+// the stage the context was given to. The zero value is returned if the target
+// did not declare the flag.
+func BoolFlagValue(ctxt context.Context, name string) bool {
+	return flagValue[bool](ctxt, name)
+}
+
+// Returns the value of the supplied int flag for the target that is running
+// the stage the context was given to. The zero value is returned if the target
+// did not declare the flag.
+func IntFlagValue(ctxt context.Context, name string) int {
+	return flagValue[int](ctxt, name)
+}
+
+// Returns the value of the supplied duration flag for the target that is
+// running the stage the context was given to. The zero value is returned if
+// the target did not declare the flag.
+func DurationFlagValue(ctxt context.Context, name string) time.Duration {
+	return flagValue[time.Duration](ctxt, name)
+}
+
+// Returns the values of the supplied repeated string flag for the target that
+// is running the stage the context was given to. Nil is returned if the target
+// did not declare the flag.
+func StringsFlagValue(ctxt context.Context, name string) []string {
+	return flagValue[[]string](ctxt, name)
+}
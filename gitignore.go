@@ -0,0 +1,127 @@
+package sbbs
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+type (
+	// A single pattern from a .gitignore file.
+	gitignoreRule struct {
+		// The slash separated directory containing the .gitignore file the
+		// rule came from, relative to the root directory.
+		base     string
+		pattern  string
+		negate   bool
+		dirOnly  bool
+		anchored bool
+	}
+
+	// A simple implementation of the rules git uses to ignore files. The
+	// .gitignore files in each directory are loaded as the directories are
+	// visited. Only the most commonly used pattern syntax is supported.
+	gitignore struct {
+		root string
+		// Slash separated paths, relative to the root directory, that are
+		// always ignored.
+		always []string
+
+		mu     sync.Mutex
+		loaded map[string]struct{}
+		rules  []gitignoreRule
+	}
+)
+
+func newGitignore(root string, always ...string) *gitignore {
+	return &gitignore{
+		root:   root,
+		always: always,
+		loaded: map[string]struct{}{},
+	}
+}
+
+// Loads the .gitignore file in the supplied slash separated directory, which
+// is relative to the root directory. Directories that have already been loaded
+// are ignored.
+func (g *gitignore) loadDir(dir string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.loaded[dir]; ok {
+		return
+	}
+	g.loaded[dir] = struct{}{}
+
+	f, err := os.Open(filepath.Join(g.root, filepath.FromSlash(dir), ".gitignore"))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule := gitignoreRule{base: dir}
+		if strings.HasPrefix(line, "!") {
+			rule.negate, line = true, line[1:]
+		}
+		line = strings.TrimPrefix(line, "\\")
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly, line = true, strings.TrimSuffix(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			rule.anchored, line = true, strings.TrimPrefix(line, "/")
+		}
+		rule.pattern = line
+		g.rules = append(g.rules, rule)
+	}
+}
+
+// Returns true if the supplied slash separated path, which is relative to the
+// root directory, is ignored. The .git directory is always ignored, as are the
+// state file used by incremental stages and the paths the gitignore was
+// created with.
+func (g *gitignore) ignored(rel string, isDir bool) bool {
+	base := path.Base(rel)
+	if base == ".git" || strings.HasPrefix(base, path.Base(defaultStateFile)) {
+		return true
+	}
+	if slices.Contains(g.always, rel) {
+		return true
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	rv := false
+	for _, r := range g.rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		relToBase := rel
+		if r.base != "." {
+			if !strings.HasPrefix(rel, r.base+"/") {
+				continue
+			}
+			relToBase = strings.TrimPrefix(rel, r.base+"/")
+		}
+
+		var match bool
+		if r.anchored {
+			match = matchGlob(r.pattern, relToBase)
+		} else {
+			match = matchGlob("**/"+r.pattern, relToBase)
+		}
+		if match {
+			rv = !r.negate
+		}
+	}
+	return rv
+}
@@ -0,0 +1,83 @@
+package sbbs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGitignoreIgnored(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		".gitignore": "# A comment\n" +
+			"*.log\n" +
+			"!keep.log\n" +
+			"build/\n" +
+			"/rootOnly.txt\n" +
+			"docs/*.md\n" +
+			"\\#hash\n" +
+			"trailing.txt   \n",
+		"sub/.gitignore": "local.txt\n",
+	}
+	for name, content := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	g := newGitignore(root, "out/report.json")
+	g.loadDir(".")
+	g.loadDir("sub")
+	// Loading a directory twice must not duplicate its rules.
+	g.loadDir("sub")
+	// Directories without a .gitignore file have no rules.
+	g.loadDir("missing")
+
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"main.go", false, false},
+		{"a.log", false, true},
+		{"sub/deeper/a.log", false, true},
+		{"keep.log", false, false},
+		{"sub/keep.log", false, false},
+		{"build", true, true},
+		{"sub/build", true, true},
+		{"build", false, false},
+		{"rootOnly.txt", false, true},
+		{"sub/rootOnly.txt", false, false},
+		{"docs/a.md", false, true},
+		{"docs/sub/a.md", false, false},
+		{"#hash", false, true},
+		{"trailing.txt", false, true},
+		{"sub/local.txt", false, true},
+		{"sub/deeper/local.txt", false, true},
+		{"local.txt", false, false},
+		{"other/local.txt", false, false},
+		{".git", true, true},
+		{"sub/.git", true, true},
+		{"bs/.sbbs-state.json", false, true},
+		{"bs/.sbbs-state.json.tmp", false, true},
+		{"out/report.json", false, true},
+		{"out/other.json", false, false},
+		{"sub/out/report.json", false, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.path, func(t *testing.T) {
+			if got := g.ignored(tc.path, tc.isDir); got != tc.want {
+				t.Fatalf(
+					"ignored(%q, %t) = %t, expected %t",
+					tc.path, tc.isDir, got, tc.want,
+				)
+			}
+		})
+	}
+	if len(g.rules) != 8 {
+		t.Fatalf("Expected 8 rules, got %d", len(g.rules))
+	}
+}
@@ -0,0 +1,104 @@
+package sbbs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Returns all of the files that match any of the supplied glob patterns. In
+// addition to the syntax supported by [path.Match], a `**` path segment will
+// match zero or more directories. The returned paths are sorted and contain no
+// duplicates.
+func globFiles(patterns ...string) ([]string, error) {
+	rv := []string{}
+	for _, pattern := range patterns {
+		pattern = filepath.ToSlash(filepath.Clean(pattern))
+		if !strings.Contains(pattern, "**") {
+			matches, err := filepath.Glob(pattern)
+			if err != nil {
+				return nil, err
+			}
+			for _, m := range matches {
+				if info, err := os.Stat(m); err == nil && !info.IsDir() {
+					rv = append(rv, m)
+				}
+			}
+			continue
+		}
+
+		root := globRoot(pattern)
+		err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if d.Name() == ".git" {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if matchGlob(pattern, filepath.ToSlash(p)) {
+				rv = append(rv, p)
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	slices.Sort(rv)
+	return slices.Compact(rv), nil
+}
+
+// Returns the longest leading directory of the pattern that does not contain
+// any glob meta characters.
+func globRoot(pattern string) string {
+	segments := strings.Split(pattern, "/")
+	root := []string{}
+	for _, s := range segments[:len(segments)-1] {
+		if strings.ContainsAny(s, "*?[\\") {
+			break
+		}
+		root = append(root, s)
+	}
+	if len(root) == 0 {
+		return "."
+	}
+	if root[0] == "" {
+		return "/" + path.Join(root[1:]...)
+	}
+	return path.Join(root...)
+}
+
+// Returns true if the supplied slash separated path matches the supplied glob
+// pattern. A `**` segment in the pattern matches zero or more path segments,
+// all other segments are matched using [path.Match].
+func matchGlob(pattern string, p string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(p, "/"))
+}
+
+func matchSegments(pattern []string, p []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(p); i++ {
+				if matchSegments(pattern[1:], p[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(p) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], p[0]); !ok {
+			return false
+		}
+		pattern, p = pattern[1:], p[1:]
+	}
+	return len(p) == 0
+}
@@ -0,0 +1,114 @@
+package sbbs
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"a.go", "a.go", true},
+		{"a.go", "b.go", false},
+		{"*.go", "a.go", true},
+		{"*.go", "dir/a.go", false},
+		{"dir/*.go", "dir/a.go", true},
+		{"dir/?.go", "dir/ab.go", false},
+		{"dir/[ab].go", "dir/b.go", true},
+		{"**", "a.go", true},
+		{"**", "dir/sub/a.go", true},
+		{"**/*.go", "a.go", true},
+		{"**/*.go", "dir/sub/a.go", true},
+		{"**/*.go", "dir/sub/a.txt", false},
+		{"dir/**/*.go", "dir/a.go", true},
+		{"dir/**/*.go", "dir/sub/deeper/a.go", true},
+		{"dir/**/*.go", "other/a.go", false},
+		{"dir/**", "dir", true},
+		{"dir/**/sub/*.go", "dir/a/b/sub/a.go", true},
+		{"dir/**/sub/*.go", "dir/a/b/a.go", false},
+		{"dir/*", "dir/sub/a.go", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.pattern+"|"+tc.path, func(t *testing.T) {
+			if got := matchGlob(tc.pattern, tc.path); got != tc.want {
+				t.Fatalf(
+					"matchGlob(%q, %q) = %t, expected %t",
+					tc.pattern, tc.path, got, tc.want,
+				)
+			}
+		})
+	}
+}
+
+func TestGlobRoot(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    string
+	}{
+		{"**/*.go", "."},
+		{"*.go", "."},
+		{"dir/**/*.go", "dir"},
+		{"dir/sub/*/a.go", "dir/sub"},
+		{"/abs/dir/**", "/abs/dir"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.pattern, func(t *testing.T) {
+			if got := globRoot(tc.pattern); got != tc.want {
+				t.Fatalf("globRoot(%q) = %q, expected %q", tc.pattern, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGlobFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{
+		"a.go", "b.txt", "dir/c.go", "dir/sub/d.go", ".git/e.go",
+	} {
+		p := filepath.Join(dir, f)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Chdir(dir)
+
+	tests := []struct {
+		name     string
+		patterns []string
+		want     []string
+	}{
+		{"NoMatches", []string{"*.rs"}, []string{}},
+		{"TopLevel", []string{"*.go"}, []string{"a.go"}},
+		{"DirsAreNotFiles", []string{"*"}, []string{"a.go", "b.txt"}},
+		{
+			"Recursive",
+			[]string{"**/*.go"},
+			[]string{"a.go", "dir/c.go", "dir/sub/d.go"},
+		},
+		{
+			"NoDuplicates",
+			[]string{"dir/**/*.go", "dir/*.go"},
+			[]string{"dir/c.go", "dir/sub/d.go"},
+		},
+		{"MissingRoot", []string{"missing/**/*.go"}, []string{}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := globFiles(tc.patterns...)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Fatalf("Expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
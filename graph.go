@@ -0,0 +1,534 @@
+package sbbs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// Tracks the state of a single invocation of the build system. An
+	// invocation is shared by every target that is run as part of running the
+	// target that was requested, allowing each target to be run at most once.
+	// Independent targets are run concurrently, limited by the number of jobs
+	// the invocation was created with.
+	invocation struct {
+		bs     *BuildSystem
+		ctxt   context.Context
+		cancel context.CancelCauseFunc
+		jobs   chan struct{}
+		// When true incremental stages will run regardless of their state.
+		force bool
+		// When true a JUnit report is being written, so [RunGoTest] records
+		// the result of every test.
+		junit bool
+
+		mu   sync.Mutex
+		runs map[string]*targetRun
+		// The target runs in the order they were claimed.
+		order []*targetRun
+	}
+
+	// The result of running a single target as part of an invocation. The
+	// done channel is closed once the target has finished running.
+	targetRun struct {
+		name    string
+		done    chan struct{}
+		started bool
+		err     error
+		// The condition that caused the target to be skipped, if any.
+		skipped string
+		// The stages that were skipped because their condition was not met,
+		// they were up to date, or they were restored from the cache.
+		skippedStages []string
+		// True if the target was stopped, or never started, because another
+		// target failed or the build was interrupted.
+		cancelled bool
+		// When the target started and finished running, along with a report
+		// of every stage it ran. These are used to write the build report.
+		start  time.Time
+		end    time.Time
+		stages []*stageReport
+		// The target run whose stage ran this target, if any. A target run
+		// is blocked until every target its stages ran has finished, so the
+		// chain of callers is used to detect targets that run each other.
+		caller *targetRun
+
+		// Guards the job slot of a target run that has no caller. The slot is
+		// released while any of the targets stages are waiting on a target
+		// that is run by someone else, and is reacquired once none of them
+		// are, so the slot is only ever released once.
+		slotMu    sync.Mutex
+		holdsSlot bool
+		waiting   int
+	}
+
+	// A target that was requested to be run along with the cmd line arguments
+	// that should be given to it.
+	targetRequest struct {
+		name string
+		args []string
+	}
+
+	invocationKey struct{}
+)
+
+// Creates a new invocation of the supplied build system that will run at most
+// `jobs` targets concurrently. The supplied context is shared by all targets
+// that are run, and will be cancelled as soon as any target fails.
+func newInvocation(
+	bs *BuildSystem,
+	ctxt context.Context,
+	jobs int,
+) *invocation {
+	inv := &invocation{
+		bs:   bs,
+		jobs: make(chan struct{}, max(jobs, 1)),
+		runs: map[string]*targetRun{},
+	}
+	inv.ctxt, inv.cancel = context.WithCancelCause(ctxt)
+	return inv
+}
+
+// Returns the invocation that is attached to the supplied context, if any. A
+// context will only have an invocation attached to it if it was given to a
+// stage by the build system.
+func getInvocation(ctxt context.Context) (*invocation, bool) {
+	inv, ok := ctxt.Value(invocationKey{}).(*invocation)
+	return inv, ok
+}
+
+// Marks the supplied target as claimed by the caller if no other caller has
+// already claimed it. The returned bool indicates if the caller is now
+// responsible for running the target.
+func (inv *invocation) claim(name string) (*targetRun, bool) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	if r, ok := inv.runs[name]; ok {
+		return r, false
+	}
+	r := &targetRun{name: name, done: make(chan struct{})}
+	inv.runs[name] = r
+	inv.order = append(inv.order, r)
+	return r, true
+}
+
+// Runs the supplied target and all of its dependencies. Any targets that have
+// already been run or are currently running as part of this invocation will
+// not be run again, their results will be waited upon instead. When `caller`
+// is not nil the targets are being run by a stage of the caller that is
+// already running as part of this invocation, so the targets are run
+// sequentially using the job slot of the outermost caller rather than
+// acquiring new ones. An error is returned rather than waiting on a target
+// that is blocked by the caller, which would never finish.
+func (inv *invocation) runTarget(
+	caller *targetRun,
+	name string,
+	cmdLineArgs ...string,
+) error {
+	var holder *targetRun
+	if caller != nil {
+		holder = caller.outermost()
+	}
+	order, err := inv.bs.resolveDeps(name)
+	if err != nil {
+		return err
+	}
+	parsed, err := inv.bs.targets[name].parseArgs(cmdLineArgs)
+	if err != nil {
+		return TargetError{Target: name, Err: err}
+	}
+
+	var wg sync.WaitGroup
+	runs := make([]*targetRun, len(order))
+	for i, iterName := range order {
+		r, owner := inv.claim(iterName)
+		runs[i] = r
+		if !owner {
+			if cycle := caller.blockedBy(r); cycle != nil {
+				if iterName != name {
+					cycle = append(cycle, name)
+				}
+				return fmt.Errorf(
+					"Dependency cycle detected: %s",
+					strings.Join(append(cycle, iterName), " -> "),
+				)
+			}
+			select {
+			case <-r.done:
+				LogQuietInfo("Target '%s' already ran, skipping", iterName)
+			default:
+				LogQuietInfo(
+					"Target '%s' is already scheduled, waiting for it", iterName,
+				)
+			}
+			if iterName == name && len(cmdLineArgs) > 0 {
+				LogWarn(
+					"Target '%s' was not re-run, ignoring the supplied args: %v",
+					iterName, cmdLineArgs,
+				)
+			}
+			continue
+		}
+
+		r.caller = caller
+		t := inv.bs.targets[iterName]
+		a := parsed
+		if i < len(order)-1 {
+			// Dependencies are never given any cmd line arguments so parsing
+			// will always succeed, leaving all flags at their defaults.
+			a, _ = t.parseArgs(nil)
+		}
+		if holder != nil {
+			inv.execute(holder, t, r, a)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			inv.execute(holder, t, r, a)
+		}()
+	}
+	wg.Wait()
+
+	for _, r := range runs {
+		if err := inv.wait(holder, r); err != nil {
+			return err
+		}
+	}
+	return runs[len(runs)-1].err
+}
+
+// Returns the outermost target run in the chain of callers of the supplied
+// target run, which is the target run that holds the job slot the chain is
+// run with.
+func (r *targetRun) outermost() *targetRun {
+	for r.caller != nil {
+		r = r.caller
+	}
+	return r
+}
+
+// Returns the names of the chain of target runs that ran the supplied target
+// run, starting with the outermost, if the supplied run is part of the chain.
+// Such a run cannot finish until the supplied run has. Nil is returned if the
+// supplied run is not part of the chain.
+func (r *targetRun) blockedBy(other *targetRun) []string {
+	var rv []string
+	found := false
+	for iter := r; iter != nil; iter = iter.caller {
+		rv = append(rv, iter.name)
+		found = found || iter == other
+	}
+	if !found {
+		return nil
+	}
+	slices.Reverse(rv)
+	return rv
+}
+
+// Waits for the supplied target run to finish. When `holder` is not nil it
+// holds a job slot which is released while waiting so that the target that is
+// being waited upon is not prevented from running. An error is returned if
+// the invocation is cancelled before the target run finishes.
+func (inv *invocation) wait(holder *targetRun, r *targetRun) error {
+	select {
+	case <-r.done:
+		return nil
+	default:
+	}
+	if holder != nil {
+		holder.slotMu.Lock()
+		holder.waiting++
+		if holder.waiting == 1 && holder.holdsSlot {
+			<-inv.jobs
+			holder.holdsSlot = false
+		}
+		holder.slotMu.Unlock()
+		defer func() {
+			holder.slotMu.Lock()
+			defer holder.slotMu.Unlock()
+			holder.waiting--
+			if holder.waiting == 0 {
+				inv.acquireSlot(holder)
+			}
+		}()
+	}
+	select {
+	case <-r.done:
+		return nil
+	case <-inv.ctxt.Done():
+		// A target run that fails cancels the invocation after it is done,
+		// so its result is preferred over the cancellation.
+		select {
+		case <-r.done:
+			return nil
+		default:
+			return context.Cause(inv.ctxt)
+		}
+	}
+}
+
+// Acquires a job slot for the supplied target run, returning false if the
+// invocation was cancelled before a slot became available. The slot mutex of
+// the target run must be held, or the target run must not be shared yet.
+func (inv *invocation) acquireSlot(r *targetRun) bool {
+	select {
+	case inv.jobs <- struct{}{}:
+		r.holdsSlot = true
+		return true
+	case <-inv.ctxt.Done():
+		return false
+	}
+}
+
+// Releases the job slot of the supplied target run if it holds one.
+func (inv *invocation) releaseSlot(r *targetRun) {
+	r.slotMu.Lock()
+	defer r.slotMu.Unlock()
+	if r.holdsSlot {
+		<-inv.jobs
+		r.holdsSlot = false
+	}
+}
+
+// Runs the supplied target once all of its dependencies have finished,
+// recording the result in the supplied target run. If any dependency failed
+// the target will not be run. When `holder` is nil the target acquires its own
+// job slot, otherwise it is run using the job slot of the holder.
+func (inv *invocation) execute(
+	holder *targetRun,
+	t *Target,
+	r *targetRun,
+	a targetArgs,
+) {
+	defer func() {
+		close(r.done)
+		if r.started && r.err != nil {
+			inv.cancel(r.err)
+		}
+	}()
+
+	for _, dep := range t.deps {
+		inv.mu.Lock()
+		depRun := inv.runs[dep]
+		inv.mu.Unlock()
+
+		if err := inv.wait(holder, depRun); err != nil {
+			r.err, r.cancelled = err, true
+			return
+		}
+		if depRun.err != nil {
+			r.err = fmt.Errorf("Dependency '%s' of '%s' failed", dep, t.name)
+			return
+		}
+	}
+
+	if err := context.Cause(inv.ctxt); err != nil {
+		r.err, r.cancelled = err, true
+		return
+	}
+	if holder == nil {
+		if !inv.acquireSlot(r) {
+			r.err, r.cancelled = context.Cause(inv.ctxt), true
+			return
+		}
+		defer inv.releaseSlot(r)
+	}
+
+	r.started = true
+	r.start = time.Now()
+	r.err = t.run(inv, r, a)
+	r.end = time.Now()
+	if r.err != nil {
+		r.cancelled = reportStatus(inv.ctxt, r.err) == reportCancelled
+	}
+}
+
+// Runs all of the requested targets. When the invocation is limited to a
+// single job the targets are run in the order they were requested and no
+// further targets are run once one fails, the remaining targets are marked as
+// cancelled instead. Otherwise all of the requested targets are scheduled
+// together, sharing any common dependencies. The first error that was
+// encountered is returned.
+func (inv *invocation) runTargets(reqs []targetRequest) error {
+	if cap(inv.jobs) == 1 {
+		for i, req := range reqs {
+			err := inv.runTarget(nil, req.name, req.args...)
+			if err == nil {
+				continue
+			}
+			for _, rest := range reqs[i+1:] {
+				if r, owner := inv.claim(rest.name); owner {
+					r.err, r.cancelled = err, true
+					close(r.done)
+				}
+			}
+			return err
+		}
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(reqs))
+	for i, req := range reqs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = inv.runTarget(nil, req.name, req.args...)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Logs which of the requested targets passed, failed, were cancelled, or were
+// skipped. A target is considered cancelled if it was stopped, or never
+// started, because another target failed or the build was interrupted, and it
+// is considered skipped if it never started running for any other reason, such
+// as a dependency failing.
+func (inv *invocation) logSummary(reqs []targetRequest) {
+	LogInfo("Summary:")
+	for _, req := range reqs {
+		inv.mu.Lock()
+		r, ok := inv.runs[req.name]
+		inv.mu.Unlock()
+
+		switch {
+		case ok && r.cancelled:
+			LogWarn("\t%s: Cancelled", req.name)
+		case !ok || !r.started:
+			LogWarn("\t%s: Skipped", req.name)
+		case r.err != nil:
+			LogErr("\t%s: Failed", req.name)
+		case r.skipped != "":
+			LogSkip("\t%s: Skipped, condition not met: %s", req.name, r.skipped)
+		case len(r.skippedStages) > 0:
+			LogSuccess(
+				"\t%s: Passed, skipped stages: %s",
+				req.name, strings.Join(r.skippedStages, ", "),
+			)
+		default:
+			LogSuccess("\t%s: Passed", req.name)
+		}
+	}
+}
+
+// Returns the order that the supplied target and all of its transitive
+// dependencies need to be run in. The supplied target will always be the last
+// element in the returned list. An error is returned if a dependency is
+// missing or if a dependency cycle is found.
+func (b *BuildSystem) resolveDeps(name string) ([]string, error) {
+	return b.walkTargets(name, func(t *Target) []string { return t.deps })
+}
+
+// Returns the targets that the supplied target needs to finish before it can
+// finish, which are its dependencies and the targets its stages run with
+// [TargetAsStage].
+func (t *Target) blockingTargets() []string {
+	return append(
+		slices.Clone(t.deps),
+		stageTargets(slices.Concat(t.stages, t.finally)...)...,
+	)
+}
+
+// Visits the supplied target and every target that is reachable from it
+// through the edges returned by the supplied function, returning the targets
+// in the order they were finished being visited. An error is returned if a
+// target is missing or if a cycle is found.
+func (b *BuildSystem) walkTargets(
+	name string,
+	edges func(t *Target) []string,
+) ([]string, error) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := map[string]int{}
+	order := []string{}
+	path := []string{}
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			start := slices.Index(path, name)
+			cycle := append(slices.Clone(path[start:]), name)
+			return fmt.Errorf(
+				"Dependency cycle detected: %s", strings.Join(cycle, " -> "),
+			)
+		}
+
+		t, ok := b.targets[name]
+		if !ok {
+			if len(path) == 0 {
+				return fmt.Errorf("Unrecognized target: %s", name)
+			}
+			return fmt.Errorf(
+				"Target '%s' depends on unrecognized target '%s'",
+				path[len(path)-1], name,
+			)
+		}
+
+		state[name] = visiting
+		path = append(path, name)
+		for _, dep := range edges(t) {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = visited
+		order = append(order, name)
+		return nil
+	}
+
+	if err := visit(name); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// Checks that every target was registered without error, that every target
+// only depends on and runs targets that exist, and that there are no cycles
+// between targets, including cycles through targets that are run as stages
+// with [TargetAsStage].
+func (b *BuildSystem) validate() error {
+	if len(b.registrationErrs) > 0 {
+		return errors.Join(b.registrationErrs...)
+	}
+	names := slices.Sorted(maps.Keys(b.targets))
+	for _, name := range names {
+		if _, err := b.resolveDeps(name); err != nil {
+			return err
+		}
+		t := b.targets[name]
+		for _, ref := range stageTargets(slices.Concat(t.stages, t.finally)...) {
+			if _, ok := b.targets[ref]; !ok {
+				return fmt.Errorf(
+					"Target '%s' runs unrecognized target '%s' as a stage",
+					name, ref,
+				)
+			}
+		}
+	}
+	for _, name := range names {
+		if _, err := b.walkTargets(name, (*Target).blockingTargets); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,383 @@
+package sbbs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Disables logging for the duration of the test.
+func quietLogs(t *testing.T) {
+	SetLogHandlers()
+	t.Cleanup(func() { SetLogHandlers(NewConsoleLogHandler(os.Stderr)) })
+}
+
+func TestResolveDeps(t *testing.T) {
+	tests := []struct {
+		name    string
+		deps    map[string][]string
+		target  string
+		want    []string
+		wantErr string
+	}{
+		{
+			name:   "NoDeps",
+			deps:   map[string][]string{"a": nil},
+			target: "a",
+			want:   []string{"a"},
+		},
+		{
+			name:   "Chain",
+			deps:   map[string][]string{"a": {"b"}, "b": {"c"}, "c": nil},
+			target: "a",
+			want:   []string{"c", "b", "a"},
+		},
+		{
+			name: "Diamond",
+			deps: map[string][]string{
+				"a": {"b", "c"}, "b": {"d"}, "c": {"d"}, "d": nil,
+			},
+			target: "a",
+			want:   []string{"d", "b", "c", "a"},
+		},
+		{
+			name:   "OnlyReachableTargets",
+			deps:   map[string][]string{"a": {"b"}, "b": nil, "c": {"a"}},
+			target: "a",
+			want:   []string{"b", "a"},
+		},
+		{
+			name:    "UnrecognizedTarget",
+			deps:    map[string][]string{"a": nil},
+			target:  "x",
+			wantErr: "Unrecognized target: x",
+		},
+		{
+			name:    "UnrecognizedDep",
+			deps:    map[string][]string{"a": {"b"}, "b": {"x"}},
+			target:  "a",
+			wantErr: "Target 'b' depends on unrecognized target 'x'",
+		},
+		{
+			name:    "SelfCycle",
+			deps:    map[string][]string{"a": {"a"}},
+			target:  "a",
+			wantErr: "Dependency cycle detected: a -> a",
+		},
+		{
+			name:    "Cycle",
+			deps:    map[string][]string{"a": {"b"}, "b": {"c"}, "c": {"b"}},
+			target:  "a",
+			wantErr: "Dependency cycle detected: b -> c -> b",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b := NewBuildSystem()
+			for name, deps := range tc.deps {
+				b.RegisterTarget(context.Background(), name).DependsOn(deps...)
+			}
+			got, err := b.resolveDeps(tc.target)
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("Expected error %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Fatalf("Expected order %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		register func(b *BuildSystem)
+		wantErr  string
+	}{
+		{
+			name: "Valid",
+			register: func(b *BuildSystem) {
+				b.RegisterTarget(context.Background(), "a", TargetAsStage("b")).
+					DependsOn("c")
+				b.RegisterTarget(context.Background(), "b").DependsOn("c")
+				b.RegisterTarget(context.Background(), "c")
+			},
+		},
+		{
+			name: "DuplicateTarget",
+			register: func(b *BuildSystem) {
+				b.RegisterTarget(context.Background(), "a")
+				b.RegisterTarget(context.Background(), "a")
+			},
+			wantErr: "Duplicate target name: a",
+		},
+		{
+			name: "UnrecognizedDep",
+			register: func(b *BuildSystem) {
+				b.RegisterTarget(context.Background(), "a").DependsOn("x")
+			},
+			wantErr: "Target 'a' depends on unrecognized target 'x'",
+		},
+		{
+			name: "UnrecognizedStageTarget",
+			register: func(b *BuildSystem) {
+				b.RegisterTarget(
+					context.Background(), "a",
+					ParallelStages("p", TargetAsStage("x")),
+				)
+			},
+			wantErr: "Target 'a' runs unrecognized target 'x' as a stage",
+		},
+		{
+			name: "UnrecognizedFinallyTarget",
+			register: func(b *BuildSystem) {
+				b.RegisterTarget(context.Background(), "a").
+					Finally(TargetAsStage("x"))
+			},
+			wantErr: "Target 'a' runs unrecognized target 'x' as a stage",
+		},
+		{
+			name: "CycleThroughStage",
+			register: func(b *BuildSystem) {
+				b.RegisterTarget(context.Background(), "a", TargetAsStage("b"))
+				b.RegisterTarget(context.Background(), "b").DependsOn("a")
+			},
+			wantErr: "Dependency cycle detected: a -> b -> a",
+		},
+		{
+			name: "CycleBetweenStages",
+			register: func(b *BuildSystem) {
+				b.RegisterTarget(context.Background(), "a", TargetAsStage("b"))
+				b.RegisterTarget(context.Background(), "b", TargetAsStage("a"))
+			},
+			wantErr: "Dependency cycle detected: a -> b -> a",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b := NewBuildSystem()
+			tc.register(b)
+			err := b.validate()
+			if tc.wantErr == "" && err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if tc.wantErr != "" && (err == nil || err.Error() != tc.wantErr) {
+				t.Fatalf("Expected error %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestRunTargetsCycleThroughRunTarget(t *testing.T) {
+	quietLogs(t)
+	b := NewBuildSystem()
+	b.RegisterTarget(context.Background(), "a", Stage(
+		"run b",
+		func(ctxt context.Context, cmdLineArgs ...string) error {
+			return RunTarget(ctxt, "b")
+		},
+	))
+	b.RegisterTarget(context.Background(), "b").DependsOn("a")
+
+	done := make(chan error)
+	go func() {
+		inv := newInvocation(b, context.Background(), 1)
+		done <- inv.runTargets([]targetRequest{{name: "a"}})
+	}()
+	select {
+	case err := <-done:
+		want := "Dependency cycle detected: a -> b -> a"
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("Expected error containing %q, got %v", want, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Running a target that runs itself did not return")
+	}
+}
+
+func TestRunTargetsScheduling(t *testing.T) {
+	tests := []struct {
+		name string
+		jobs int
+		deps map[string][]string
+		// The targets that each target runs in parallel with [TargetAsStage]
+		// before doing anything else.
+		stages map[string][]string
+		fail   []string
+		reqs   []string
+		// The targets that are expected to run, each of which must run once.
+		wantRun []string
+		// The expected maximum number of targets that run at the same time.
+		wantMax int
+		// The targets that are expected to be cancelled without running.
+		wantCancelled []string
+		wantErr       bool
+	}{
+		{
+			name:    "Sequential",
+			jobs:    1,
+			deps:    map[string][]string{"a": nil, "b": nil},
+			reqs:    []string{"a", "b"},
+			wantRun: []string{"a", "b"},
+			wantMax: 1,
+		},
+		{
+			name:    "Concurrent",
+			jobs:    2,
+			deps:    map[string][]string{"a": nil, "b": nil},
+			reqs:    []string{"a", "b"},
+			wantRun: []string{"a", "b"},
+			wantMax: 2,
+		},
+		{
+			name:    "LimitedByJobs",
+			jobs:    2,
+			deps:    map[string][]string{"a": nil, "b": nil, "c": nil},
+			reqs:    []string{"a", "b", "c"},
+			wantRun: []string{"a", "b", "c"},
+			wantMax: 2,
+		},
+		{
+			name:    "SharedDepRunsOnce",
+			jobs:    3,
+			deps:    map[string][]string{"a": {"c"}, "b": {"c"}, "c": nil},
+			reqs:    []string{"a", "b"},
+			wantRun: []string{"a", "b", "c"},
+			wantMax: 2,
+		},
+		{
+			name:    "DepChainIsSequential",
+			jobs:    3,
+			deps:    map[string][]string{"a": {"b"}, "b": {"c"}, "c": nil},
+			reqs:    []string{"a"},
+			wantRun: []string{"a", "b", "c"},
+			wantMax: 1,
+		},
+		{
+			name:          "FailureStopsSequentialTargets",
+			jobs:          1,
+			deps:          map[string][]string{"a": nil, "b": nil},
+			fail:          []string{"a"},
+			reqs:          []string{"a", "b"},
+			wantRun:       []string{"a"},
+			wantMax:       1,
+			wantCancelled: []string{"b"},
+			wantErr:       true,
+		},
+		{
+			name:    "FailedDepSkipsDependents",
+			jobs:    2,
+			deps:    map[string][]string{"a": {"c"}, "b": {"c"}, "c": nil},
+			fail:    []string{"c"},
+			reqs:    []string{"a", "b"},
+			wantRun: []string{"c"},
+			wantMax: 1,
+			wantErr: true,
+		},
+		{
+			name: "NestedWaitersShareOneSlot",
+			jobs: 2,
+			deps: map[string][]string{
+				"a": nil, "b": {"x", "y"}, "x": {"d"}, "y": {"d"}, "d": nil,
+			},
+			stages:  map[string][]string{"a": {"x", "y"}},
+			reqs:    []string{"a", "b"},
+			wantRun: []string{"a", "b", "d", "x", "y"},
+			wantMax: 2,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			quietLogs(t)
+			var mu sync.Mutex
+			runs := map[string]int{}
+			finished := map[string]bool{}
+			running, maxRunning := 0, 0
+
+			b := NewBuildSystem()
+			for name, deps := range tc.deps {
+				op := func(ctxt context.Context, cmdLineArgs ...string) error {
+					stages := []Stager{}
+					for _, target := range tc.stages[name] {
+						stages = append(stages, TargetAsStage(target))
+					}
+					err := ParallelStages("run", stages...).Run(ctxt, cmdLineArgs...)
+					if err != nil {
+						return err
+					}
+
+					mu.Lock()
+					runs[name]++
+					running++
+					maxRunning = max(maxRunning, running)
+					for _, dep := range deps {
+						if !finished[dep] {
+							t.Errorf("'%s' started before '%s' finished", name, dep)
+						}
+					}
+					mu.Unlock()
+
+					time.Sleep(50 * time.Millisecond)
+
+					mu.Lock()
+					running--
+					finished[name] = true
+					mu.Unlock()
+					if slices.Contains(tc.fail, name) {
+						return errors.New("Failed")
+					}
+					return nil
+				}
+				b.RegisterTarget(context.Background(), name, StageFunc(op)).
+					DependsOn(deps...)
+			}
+
+			reqs := []targetRequest{}
+			for _, name := range tc.reqs {
+				reqs = append(reqs, targetRequest{name: name})
+			}
+			inv := newInvocation(b, context.Background(), tc.jobs)
+			done := make(chan error)
+			go func() { done <- inv.runTargets(reqs) }()
+			var err error
+			select {
+			case err = <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Running the targets did not return")
+			}
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("Expected an error: %t, got %v", tc.wantErr, err)
+			}
+			for _, name := range tc.wantRun {
+				if runs[name] != 1 {
+					t.Errorf("Expected '%s' to run once, ran %d times", name, runs[name])
+				}
+			}
+			if len(runs) != len(tc.wantRun) {
+				t.Errorf("Expected %v to run, got %v", tc.wantRun, runs)
+			}
+			for _, name := range tc.wantCancelled {
+				if r, ok := inv.runs[name]; !ok || !r.cancelled {
+					t.Errorf("Expected '%s' to be cancelled", name)
+				}
+			}
+			if maxRunning != tc.wantMax {
+				t.Errorf(
+					"Expected at most %d targets to run at once, got %d",
+					tc.wantMax, maxRunning,
+				)
+			}
+		})
+	}
+}
@@ -0,0 +1,231 @@
+package sbbs
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	// The name of the built in target that prints help for other targets.
+	helpTargetName = "help"
+	// The category that targets without a category are listed under.
+	defaultCategory = "Targets"
+	// The name that is listed for stages that were not created by this
+	// package, such as a plain function.
+	unnamedStage = "<unnamed stage>"
+)
+
+type (
+	// A stage created by this package, which knows the names it is listed
+	// under in a targets help without having to be run.
+	namedStage struct {
+		run   StageFunc
+		names []string
+		// The targets the stage runs with [TargetAsStage], which are checked
+		// when the build system is validated.
+		targets []string
+	}
+)
+
+// Sets the description of the target. The description is shown next to the
+// target in the build systems usage and at the top of the targets help.
+func (t *Target) Description(description string) *Target {
+	t.description = description
+	return t
+}
+
+// Sets the usage of the target, describing the cmd line arguments the target
+// accepts. The usage is shown in the targets help after the target name.
+func (t *Target) Usage(usage string) *Target {
+	t.usage = usage
+	return t
+}
+
+// Sets the category of the target. Targets are grouped by category in the
+// build systems usage.
+func (t *Target) Category(category string) *Target {
+	t.category = category
+	return t
+}
+
+// Returns the names of the targets stages in the order they will be run.
+func (t *Target) stageNames() []string {
+	rv := make([]string, 0, len(t.stages))
+	for _, s := range t.stages {
+		rv = append(rv, s.Names()...)
+	}
+	return rv
+}
+
+// Creates a stage that runs the supplied function and is listed under the
+// supplied names in a targets help. The supplied targets are the targets the
+// stage runs with [TargetAsStage], which are checked when the build system is
+// validated.
+func nameStage(run StageFunc, names []string, targets []string) Stager {
+	return &namedStage{run: run, names: names, targets: targets}
+}
+
+// Creates a stage that runs the supplied function in place of the wrapped
+// stage, giving it the names and targets of the wrapped stage.
+func wrapStage(run StageFunc, wrapped Stager) Stager {
+	return nameStage(run, wrapped.Names(), stageTargets(wrapped))
+}
+
+func (s *namedStage) Run(ctxt context.Context, cmdLineArgs ...string) error {
+	return s.run(ctxt, cmdLineArgs...)
+}
+
+func (s *namedStage) Names() []string {
+	return s.names
+}
+
+// Returns the targets that the supplied stages run with [TargetAsStage].
+func stageTargets(stages ...Stager) []string {
+	rv := []string{}
+	for _, s := range stages {
+		if n, ok := s.(*namedStage); ok {
+			rv = append(rv, n.targets...)
+		}
+	}
+	return rv
+}
+
+// Logs the supplied rows as an indented table with aligned columns. Columns
+// are separated by tabs.
+func logTable(rows ...string) {
+	var sb strings.Builder
+	w := tabwriter.NewWriter(&sb, 0, 4, 2, ' ', 0)
+	for _, r := range rows {
+		w.Write([]byte(r + "\n"))
+	}
+	w.Flush()
+	for _, line := range strings.Split(strings.TrimSuffix(sb.String(), "\n"), "\n") {
+		LogInfo("\t  %s", line)
+	}
+}
+
+func (b *BuildSystem) logUsage(progName string) {
+	LogInfo("Usage:")
+	LogInfo(
+		"\t%s [flags] [target | -h | --help] [target specific args...]",
+		progName,
+	)
+	LogInfo(
+		"\t%s [flags] target [target...] [-- last target specific args...]",
+		progName,
+	)
+	LogInfo("\t%s help <target>", progName)
+
+	categories := map[string][]*Target{}
+	for _, t := range b.targets {
+		category := t.category
+		if category == "" {
+			category = defaultCategory
+		}
+		categories[category] = append(categories[category], t)
+	}
+	for _, category := range slices.Sorted(maps.Keys(categories)) {
+		iterTargets := categories[category]
+		slices.SortFunc(iterTargets, func(l, r *Target) int {
+			return strings.Compare(l.name, r.name)
+		})
+		LogInfo("%s:", category)
+		rows := make([]string, len(iterTargets))
+		for i, t := range iterTargets {
+			rows[i] = t.name + "\t" + t.description
+		}
+		logTable(rows...)
+	}
+
+	LogInfo("Flags:")
+	logTable(
+		"-j N\tRun up to N independent targets concurrently (default 1)",
+		"-force\tRun incremental stages even if they are up to date",
+		"-watch\tRerun the targets every time a file in the repository changes",
+		"-timeout D\tStop all targets once the duration D, such as 10m, has passed",
+		"-v\tLog debug information, such as the commands that are run",
+		"-q\tOnly log warnings and errors",
+		"-color WHEN\tColor the logs: auto, always, or never (default auto)",
+		"-log-json PATH\tAlso append all logs to PATH as JSON lines",
+		"-report PATH\tWrite a JSON report of the run to PATH",
+		"-junit PATH\tWrite a JUnit XML report of the run to PATH",
+		"-h, --help\tPrint this message",
+	)
+}
+
+// Logs the documentation for the supplied target, including the stages that
+// will be run when the target is run.
+func (b *BuildSystem) logTargetHelp(progName string, t *Target) {
+	LogInfo("Target: %s", t.name)
+	if t.description != "" {
+		LogInfo("\t%s", t.description)
+	}
+	usage := t.usage
+	if usage == "" && len(t.flags) > 0 {
+		usage = "[target flags...] [args...]"
+	}
+	LogInfo("Usage:")
+	LogInfo(
+		"\t%s", strings.TrimSpace(progName+" [flags] "+t.name+" "+usage),
+	)
+	if len(t.flags) > 0 {
+		LogInfo("Target Flags:")
+		logTable(t.flagRows()...)
+	}
+	if t.category != "" {
+		LogInfo("Category: %s", t.category)
+	}
+	if len(t.deps) > 0 {
+		LogInfo("Depends On: %s", strings.Join(t.deps, ", "))
+	}
+	if t.timeout > 0 {
+		LogInfo("Timeout: %s", t.timeout)
+	}
+	if t.logLevel != nil {
+		LogInfo("Log Level: %s", *t.logLevel)
+	}
+	if len(t.conds) > 0 {
+		LogInfo("Runs When:")
+		for _, cond := range t.conds {
+			LogInfo("\t%s", cond.Desc)
+		}
+	}
+	LogInfo("Stages:")
+	for i, name := range t.stageNames() {
+		LogInfo("\t%d. %s", i+1, name)
+	}
+	if len(t.finally) > 0 {
+		LogInfo("Finally:")
+		i := 0
+		for _, s := range t.finally {
+			for _, name := range s.Names() {
+				i++
+				LogInfo("\t%d. %s", i, name)
+			}
+		}
+	}
+}
+
+// Runs the built in help target, logging the help for each of the supplied
+// targets or the build systems usage if no targets are supplied. Returns the
+// exit code the program should exit with.
+func (b *BuildSystem) help(progName string, targetNames ...string) int {
+	if len(targetNames) == 0 {
+		b.logUsage(progName)
+		return 0
+	}
+	for _, name := range targetNames {
+		t, ok := b.targets[name]
+		if !ok {
+			LogErr("An invalid target was provided: %s", name)
+			b.logUsage(progName)
+			LogQuietInfo("Consider: Re-runing with a valid target")
+			return 1
+		}
+		b.logTargetHelp(progName, t)
+	}
+	return 0
+}
@@ -0,0 +1,246 @@
+package sbbs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	// The env variable that can be used to override the location of the state
+	// file that incremental stages use.
+	StateFileEnvVar = "SBBS_STATE_FILE"
+	// The location of the state file that incremental stages use, relative to
+	// the repositories root directory.
+	defaultStateFile = "bs/.sbbs-state.json"
+)
+
+type (
+	// Defines the files that an incremental stage reads and produces. See
+	// [Incremental].
+	IncrementalOpts struct {
+		// The key the stages state is stored under. This must be unique across
+		// all incremental stages in the build system. If empty, the name of
+		// the wrapped stage is used, in which case the wrapped stage must have
+		// been created with [Stage].
+		Key string
+		// Glob patterns matching the files the stage reads. Patterns are
+		// relative to the current working directory when the stage is run and
+		// a `**` path segment will match zero or more directories.
+		Inputs []string
+		// Glob patterns matching the files the stage produces. These follow
+		// the same rules as Inputs.
+		Outputs []string
+	}
+
+	// The hashes of the files an incremental stage read and produced the last
+	// time it successfully ran.
+	incrementalState struct {
+		Inputs  map[string]string `json:"inputs"`
+		Outputs map[string]string `json:"outputs"`
+	}
+)
+
+// Guards reading and writing the state file so that incremental stages that
+// are run concurrently do not overwrite each others state.
+var stateFileMu sync.Mutex
+
+// Creates a stage that only runs the supplied stage if its inputs or outputs
+// have changed since the last time it successfully ran. The hashes of the
+// inputs and outputs are stored in a state file, which is located at
+// `bs/.sbbs-state.json` relative to the repositories root directory unless
+// overridden by the [StateFileEnvVar] env variable. The reason a stage is run
+// or skipped is always logged, and stages that are skipped are recorded as
+// skipped in the summary and reports. The `-force` flag can be given to [Main]
+// to run all incremental stages regardless of their state.
+func Incremental(opts IncrementalOpts, stage Stager) Stager {
+	names := stage.Names()
+	key := opts.Key
+	if key == "" {
+		key = strings.Join(names, ", ")
+	}
+
+	return wrapStage(func(ctxt context.Context, cmdLineArgs ...string) error {
+		if key == unnamedStage {
+			return errors.New(
+				"Incremental stages that wrap an unnamed stage must be given a key",
+			)
+		}
+
+		statePath := stateFilePath(ctxt)
+		reason, err := incrementalReason(ctxt, statePath, key, opts)
+		if err != nil {
+			return err
+		}
+		if reason == "" {
+			LogSkipContext(ctxt, "Stage '%s': Up to date, skipping", key)
+			recordSkippedStages(ctxt, "Up to date", names...)
+			return nil
+		}
+		LogInfoContext(ctxt, "Stage '%s': Running because %s", key, reason)
+
+		if err := stage.Run(ctxt, cmdLineArgs...); err != nil {
+			return err
+		}
+
+		// The inputs are hashed again because the stage may have modified
+		// them, such as when formatting code.
+		var state incrementalState
+		if state.Inputs, err = hashGlobs(opts.Inputs...); err != nil {
+			return err
+		}
+		if state.Outputs, err = hashGlobs(opts.Outputs...); err != nil {
+			return err
+		}
+		return updateState(statePath, key, state)
+	}, stage)
+}
+
+// Returns the reason the incremental stage with the supplied key needs to be
+// run. An empty string is returned if the stage is up to date.
+func incrementalReason(
+	ctxt context.Context,
+	statePath string,
+	key string,
+	opts IncrementalOpts,
+) (string, error) {
+	if inv, ok := getInvocation(ctxt); ok && inv.force {
+		return "the -force flag was supplied", nil
+	}
+
+	states, err := loadStates(statePath)
+	if err != nil {
+		return "", err
+	}
+	prev, ok := states[key]
+	if !ok {
+		return "there is no record of a previous run", nil
+	}
+
+	inputs, err := hashGlobs(opts.Inputs...)
+	if err != nil {
+		return "", err
+	}
+	if reason := diffHashes("input", prev.Inputs, inputs); reason != "" {
+		return reason, nil
+	}
+	outputs, err := hashGlobs(opts.Outputs...)
+	if err != nil {
+		return "", err
+	}
+	return diffHashes("output", prev.Outputs, outputs), nil
+}
+
+// Returns a description of the first difference between the supplied file
+// hashes. An empty string is returned if there are no differences.
+func diffHashes(kind string, prev map[string]string, cur map[string]string) string {
+	for _, p := range slices.Sorted(maps.Keys(cur)) {
+		prevHash, ok := prev[p]
+		if !ok {
+			return fmt.Sprintf("%s '%s' was added", kind, p)
+		}
+		if prevHash != cur[p] {
+			return fmt.Sprintf("%s '%s' changed", kind, p)
+		}
+	}
+	for _, p := range slices.Sorted(maps.Keys(prev)) {
+		if _, ok := cur[p]; !ok {
+			return fmt.Sprintf("%s '%s' was removed", kind, p)
+		}
+	}
+	return ""
+}
+
+// Returns the sha256 hash of every file that matches the supplied glob
+// patterns, keyed by the files path.
+func hashGlobs(patterns ...string) (map[string]string, error) {
+	files, err := globFiles(patterns...)
+	if err != nil {
+		return nil, err
+	}
+	rv := make(map[string]string, len(files))
+	for _, f := range files {
+		if rv[f], err = hashFile(f); err != nil {
+			return nil, err
+		}
+	}
+	return rv, nil
+}
+
+// Returns the hex encoded sha256 hash of the supplied files contents.
+func hashFile(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Returns the path of the state file used by incremental stages.
+func stateFilePath(ctxt context.Context) string {
+	if p, ok := os.LookupEnv(StateFileEnvVar); ok {
+		return p
+	}
+	root, err := GitRevParse(ctxt)
+	if err != nil || root == "" {
+		return defaultStateFile
+	}
+	return filepath.Join(root, defaultStateFile)
+}
+
+func loadStates(statePath string) (map[string]incrementalState, error) {
+	stateFileMu.Lock()
+	defer stateFileMu.Unlock()
+	return readStates(statePath)
+}
+
+func readStates(statePath string) (map[string]incrementalState, error) {
+	rv := map[string]incrementalState{}
+	data, err := os.ReadFile(statePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return rv, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &rv); err != nil {
+		LogWarn("Ignoring malformed state file '%s': %s", statePath, err)
+		return map[string]incrementalState{}, nil
+	}
+	return rv, nil
+}
+
+// Sets the state of the incremental stage with the supplied key, preserving
+// the state of all other stages. The state file is replaced atomically.
+func updateState(statePath string, key string, state incrementalState) error {
+	stateFileMu.Lock()
+	defer stateFileMu.Unlock()
+
+	states, err := readStates(statePath)
+	if err != nil {
+		return err
+	}
+	states[key] = state
+
+	data, err := json.MarshalIndent(states, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(statePath, data)
+}
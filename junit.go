@@ -0,0 +1,407 @@
+package sbbs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// The name of the test case that is used to report a go package that failed
+// without any of its tests failing, such as when it does not compile.
+const goTestPackageCase = "(package)"
+
+// Matches the escape sequences that are used to color terminal output, which
+// cannot be represented in XML.
+var ansiEscape = regexp.MustCompile("\x1b\\[[0-9;?]*[ -/]*[@-~]")
+
+type (
+	// The root element of a JUnit report, see [Main].
+	junitTestSuites struct {
+		XMLName  xml.Name         `xml:"testsuites"`
+		Name     string           `xml:"name,attr"`
+		Tests    int              `xml:"tests,attr"`
+		Failures int              `xml:"failures,attr"`
+		Skipped  int              `xml:"skipped,attr"`
+		Time     string           `xml:"time,attr"`
+		Suites   []junitTestSuite `xml:"testsuite"`
+	}
+
+	junitTestSuite struct {
+		Name      string          `xml:"name,attr"`
+		Tests     int             `xml:"tests,attr"`
+		Failures  int             `xml:"failures,attr"`
+		Skipped   int             `xml:"skipped,attr"`
+		Time      string          `xml:"time,attr"`
+		Timestamp string          `xml:"timestamp,attr,omitempty"`
+		Cases     []junitTestCase `xml:"testcase"`
+	}
+
+	junitTestCase struct {
+		ClassName string        `xml:"classname,attr"`
+		Name      string        `xml:"name,attr"`
+		Time      string        `xml:"time,attr"`
+		Failure   *junitMessage `xml:"failure,omitempty"`
+		Skipped   *junitMessage `xml:"skipped,omitempty"`
+		SystemOut string        `xml:"system-out,omitempty"`
+	}
+
+	junitMessage struct {
+		Message string `xml:"message,attr"`
+		Text    string `xml:",chardata"`
+	}
+
+	// A single event that is printed by `go test -json`. See `go doc
+	// test2json` for details.
+	goTestEvent struct {
+		Action  string
+		Package string
+		Test    string
+		Elapsed float64
+		Output  string
+		// The package that build output belongs to and the package whose
+		// build failed, which are used instead of the package when a test
+		// binary does not compile.
+		ImportPath  string
+		FailedBuild string
+	}
+
+	// The result of a single go test, or of a package that failed without
+	// any of its tests failing.
+	goTestCase struct {
+		pkg     string
+		name    string
+		status  string
+		elapsed float64
+		output  strings.Builder
+	}
+
+	// A writer that parses the output of `go test -json`, printing the test
+	// output in the same format as `go test -v` and recording the result of
+	// every test.
+	goTestJSONWriter struct {
+		out     io.Writer
+		partial []byte
+		cases   map[string]*goTestCase
+		pkgs    map[string]*goTestCase
+		builds  map[string]*strings.Builder
+		order   []*goTestCase
+	}
+)
+
+// Runs `go test` with the supplied args, printing its output to stdout. When a
+// JUnit report is being written, see [Main], the tests are run with the `-json`
+// flag and every test is added to the report as its own test case. In that
+// case the output of every test is printed, in the same format as `go test
+// -v`, even if the `-v` flag was not supplied.
+func RunGoTest(ctxt context.Context, args ...string) error {
+	inv, ok := getInvocation(ctxt)
+	if !ok || !inv.junit {
+		return RunStdout(ctxt, "go", append([]string{"test"}, args...)...)
+	}
+
+	stdout := consoleWriter(ctxt, os.Stdout)
+	defer stdout.Close()
+	w := &goTestJSONWriter{
+		out:    stdout,
+		cases:  map[string]*goTestCase{},
+		pkgs:   map[string]*goTestCase{},
+		builds: map[string]*strings.Builder{},
+	}
+	_, err := Cmd("go", append([]string{"test", "-json"}, args...)...).
+		Stdout(w).
+		Run(ctxt)
+	w.Close()
+
+	// Tests that never finished, such as when the tests timed out, are given
+	// the status of the whole run.
+	for _, c := range w.order {
+		if c.status == "" {
+			c.status = reportStatus(ctxt, err)
+		}
+	}
+	if s := getStageReport(ctxt); s != nil {
+		inv.mu.Lock()
+		s.tests = append(s.tests, w.order...)
+		inv.mu.Unlock()
+	}
+	return err
+}
+
+func (w *goTestJSONWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.handleLine(w.partial[:i+1])
+		w.partial = w.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *goTestJSONWriter) Close() error {
+	if len(w.partial) > 0 {
+		w.handleLine(append(w.partial, '\n'))
+		w.partial = nil
+	}
+	return nil
+}
+
+// Handles a single line of output. Lines that are not test events, such as
+// those printed by a test binary that writes to stdout directly, are printed
+// as is.
+func (w *goTestJSONWriter) handleLine(line []byte) {
+	var ev goTestEvent
+	if !bytes.HasPrefix(line, []byte("{")) || json.Unmarshal(line, &ev) != nil {
+		w.out.Write(line)
+		return
+	}
+
+	switch ev.Action {
+	case "build-output":
+		w.out.Write([]byte(ev.Output))
+		if _, ok := w.builds[ev.ImportPath]; !ok {
+			w.builds[ev.ImportPath] = &strings.Builder{}
+		}
+		w.builds[ev.ImportPath].WriteString(ev.Output)
+	case "output":
+		w.out.Write([]byte(ev.Output))
+		if ev.Test != "" {
+			w.testCase(ev.Package, ev.Test).output.WriteString(ev.Output)
+		} else if ev.Package != "" {
+			w.pkgCase(ev.Package).output.WriteString(ev.Output)
+		}
+	case "run":
+		w.testCase(ev.Package, ev.Test)
+	case "pass", "fail", "skip":
+		if ev.Test != "" {
+			c := w.testCase(ev.Package, ev.Test)
+			c.status, c.elapsed = goTestStatus(ev.Action), ev.Elapsed
+			return
+		}
+		// A package that failed without any failed tests is reported as a
+		// failure of its own so that the failure is not lost.
+		pkg := w.pkgCase(ev.Package)
+		if ev.Action != "fail" {
+			return
+		}
+		for _, c := range w.order {
+			if c.pkg == ev.Package && c.status == reportFailed {
+				return
+			}
+		}
+		pkg.status, pkg.elapsed = reportFailed, ev.Elapsed
+		if build, ok := w.builds[ev.FailedBuild]; ok {
+			output := build.String() + pkg.output.String()
+			pkg.output.Reset()
+			pkg.output.WriteString(output)
+		}
+		w.order = append(w.order, pkg)
+	}
+}
+
+// Returns the test case for the supplied test, creating it if needed.
+func (w *goTestJSONWriter) testCase(pkg string, name string) *goTestCase {
+	key := pkg + "\x00" + name
+	if c, ok := w.cases[key]; ok {
+		return c
+	}
+	c := &goTestCase{pkg: pkg, name: name}
+	w.cases[key] = c
+	w.order = append(w.order, c)
+	return c
+}
+
+// Returns the test case that collects the output of the supplied package that
+// was not written by any test.
+func (w *goTestJSONWriter) pkgCase(pkg string) *goTestCase {
+	if c, ok := w.pkgs[pkg]; ok {
+		return c
+	}
+	c := &goTestCase{pkg: pkg, name: goTestPackageCase}
+	w.pkgs[pkg] = c
+	return c
+}
+
+// Returns the report of the stage that was given the supplied context if the
+// stages output should be captured, which is only done when a JUnit report is
+// being written.
+func junitOutput(ctxt context.Context) *stageReport {
+	if inv, ok := getInvocation(ctxt); ok && inv.junit {
+		return getStageReport(ctxt)
+	}
+	return nil
+}
+
+// Translates a `go test -json` action to a report status.
+func goTestStatus(action string) string {
+	switch action {
+	case "pass":
+		return reportSuccess
+	case "skip":
+		return reportSkipped
+	}
+	return reportFailed
+}
+
+// Returns the number of seconds in the supplied duration in the format used by
+// JUnit reports.
+func junitTime(seconds float64) string {
+	return fmt.Sprintf("%.3f", seconds)
+}
+
+// Adds the supplied test case to the suite, updating the suites counts.
+func (s *junitTestSuite) add(c junitTestCase) {
+	s.Tests++
+	if c.Failure != nil {
+		s.Failures++
+	}
+	if c.Skipped != nil {
+		s.Skipped++
+	}
+	s.Cases = append(s.Cases, c)
+}
+
+// Creates a JUnit test case with the supplied status. Cancelled test cases are
+// reported as skipped because they did not fail on their own. Any color codes
+// are removed from the error message and output.
+func newJUnitTestCase(
+	class string,
+	name string,
+	seconds float64,
+	status string,
+	errMsg string,
+	output string,
+) junitTestCase {
+	errMsg = ansiEscape.ReplaceAllString(errMsg, "")
+	rv := junitTestCase{
+		ClassName: class,
+		Name:      name,
+		Time:      junitTime(seconds),
+		SystemOut: ansiEscape.ReplaceAllString(output, ""),
+	}
+	switch status {
+	case reportFailed:
+		rv.Failure = &junitMessage{Message: errMsg, Text: errMsg}
+	case reportSkipped:
+		rv.Skipped = &junitMessage{Message: errMsg}
+	case reportCancelled:
+		rv.Skipped = &junitMessage{Message: "Cancelled: " + errMsg}
+	}
+	return rv
+}
+
+// Writes a JUnit report of the invocation to the supplied path. Every target
+// is reported as a test suite that contains a test case for each of its
+// stages. The results of any go tests that were run with [RunGoTest] are
+// reported as a test suite for each go package.
+func (inv *invocation) writeJUnit(
+	path string,
+	progName string,
+	start time.Time,
+	reqs []targetRequest,
+) error {
+	rep := junitTestSuites{
+		Name: progName,
+		Time: junitTime(time.Since(start).Seconds()),
+	}
+	pkgSuites := map[string]int{}
+	var pkgs []junitTestSuite
+	var pkgTimes []float64
+
+	inv.mu.Lock()
+	for _, r := range inv.order {
+		suite := junitTestSuite{
+			Name: r.name,
+			Time: junitTime(r.end.Sub(r.start).Seconds()),
+		}
+		if !r.start.IsZero() {
+			suite.Timestamp = r.start.Format(time.RFC3339)
+		}
+		errMsg := r.skipped
+		if r.err != nil {
+			errMsg = r.err.Error()
+		}
+		if len(r.stages) == 0 {
+			suite.add(newJUnitTestCase(
+				r.name, r.name, 0, r.reportStatus(), errMsg, "",
+			))
+		}
+
+		seen := map[string]int{}
+		for _, s := range r.stages {
+			// Stages commonly share names, such as the diff stages of the
+			// mergegate target, so repeated names are numbered to keep the
+			// test cases distinct.
+			name := s.Name
+			if seen[s.Name]++; seen[s.Name] > 1 {
+				name = fmt.Sprintf("%s (%d)", s.Name, seen[s.Name])
+			}
+			stageErr := s.Error
+			if s.Status == reportSkipped {
+				stageErr = s.SkipReason
+			}
+			suite.add(newJUnitTestCase(
+				r.name, name, s.End.Sub(s.Start).Seconds(), s.Status,
+				stageErr, s.output.buf.String(),
+			))
+
+			for _, t := range s.tests {
+				i, ok := pkgSuites[t.pkg]
+				if !ok {
+					i = len(pkgs)
+					pkgSuites[t.pkg] = i
+					pkgs = append(pkgs, junitTestSuite{Name: t.pkg})
+					pkgTimes = append(pkgTimes, 0)
+				}
+				pkgTimes[i] += t.elapsed
+				testErr := ""
+				if t.status != reportSuccess && t.name == goTestPackageCase {
+					testErr = fmt.Sprintf("%s %s", t.pkg, t.status)
+				} else if t.status != reportSuccess {
+					testErr = fmt.Sprintf("%s %s", t.name, t.status)
+				}
+				pkgs[i].add(newJUnitTestCase(
+					t.pkg, t.name, t.elapsed, t.status, testErr,
+					t.output.String(),
+				))
+			}
+		}
+		rep.Suites = append(rep.Suites, suite)
+	}
+	for _, req := range reqs {
+		if _, ok := inv.runs[req.name]; !ok {
+			suite := junitTestSuite{Name: req.name, Time: junitTime(0)}
+			suite.add(newJUnitTestCase(
+				req.name, req.name, 0, reportSkipped, "Not run", "",
+			))
+			rep.Suites = append(rep.Suites, suite)
+		}
+	}
+	inv.mu.Unlock()
+
+	for i := range pkgs {
+		pkgs[i].Time = junitTime(pkgTimes[i])
+	}
+	rep.Suites = append(rep.Suites, pkgs...)
+	for _, s := range rep.Suites {
+		rep.Tests += s.Tests
+		rep.Failures += s.Failures
+		rep.Skipped += s.Skipped
+	}
+
+	data, err := xml.MarshalIndent(rep, "", "\t")
+	if err != nil {
+		return err
+	}
+	data = append([]byte(xml.Header), data...)
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
@@ -0,0 +1,173 @@
+package sbbs
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// Returns the supplied events as the lines `go test -json` would print.
+func goTestJSON(t *testing.T, events ...goTestEvent) string {
+	var sb strings.Builder
+	for _, ev := range events {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sb.Write(data)
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+func TestGoTestJSONWriter(t *testing.T) {
+	type wantCase struct {
+		pkg    string
+		name   string
+		status string
+		output string
+	}
+	tests := []struct {
+		name       string
+		input      string
+		wantOutput string
+		wantCases  []wantCase
+	}{
+		{
+			name: "PassingTest",
+			input: goTestJSON(t,
+				goTestEvent{Action: "start", Package: "pkg"},
+				goTestEvent{Action: "run", Package: "pkg", Test: "TestA"},
+				goTestEvent{Action: "output", Package: "pkg", Test: "TestA", Output: "=== RUN   TestA\n"},
+				goTestEvent{Action: "output", Package: "pkg", Test: "TestA", Output: "--- PASS: TestA (0.10s)\n"},
+				goTestEvent{Action: "pass", Package: "pkg", Test: "TestA", Elapsed: 0.1},
+				goTestEvent{Action: "output", Package: "pkg", Output: "ok  \tpkg\t0.1s\n"},
+				goTestEvent{Action: "pass", Package: "pkg", Elapsed: 0.1},
+			),
+			wantOutput: "=== RUN   TestA\n--- PASS: TestA (0.10s)\nok  \tpkg\t0.1s\n",
+			wantCases: []wantCase{{
+				pkg: "pkg", name: "TestA", status: reportSuccess,
+				output: "=== RUN   TestA\n--- PASS: TestA (0.10s)\n",
+			}},
+		},
+		{
+			name: "FailingAndSkippedTests",
+			input: goTestJSON(t,
+				goTestEvent{Action: "run", Package: "pkg", Test: "TestA"},
+				goTestEvent{Action: "output", Package: "pkg", Test: "TestA", Output: "failed\n"},
+				goTestEvent{Action: "fail", Package: "pkg", Test: "TestA"},
+				goTestEvent{Action: "run", Package: "pkg", Test: "TestB"},
+				goTestEvent{Action: "skip", Package: "pkg", Test: "TestB"},
+				goTestEvent{Action: "fail", Package: "pkg"},
+			),
+			wantOutput: "failed\n",
+			wantCases: []wantCase{
+				{pkg: "pkg", name: "TestA", status: reportFailed, output: "failed\n"},
+				{pkg: "pkg", name: "TestB", status: reportSkipped},
+			},
+		},
+		{
+			name: "SameTestInTwoPackages",
+			input: goTestJSON(t,
+				goTestEvent{Action: "run", Package: "a", Test: "TestA"},
+				goTestEvent{Action: "run", Package: "b", Test: "TestA"},
+				goTestEvent{Action: "pass", Package: "b", Test: "TestA"},
+				goTestEvent{Action: "fail", Package: "a", Test: "TestA"},
+			),
+			wantCases: []wantCase{
+				{pkg: "a", name: "TestA", status: reportFailed},
+				{pkg: "b", name: "TestA", status: reportSuccess},
+			},
+		},
+		{
+			name: "BuildFailure",
+			input: goTestJSON(t,
+				goTestEvent{Action: "build-output", ImportPath: "pkg [pkg.test]", Output: "pkg/a.go:1: bad\n"},
+				goTestEvent{Action: "build-fail", ImportPath: "pkg [pkg.test]"},
+				goTestEvent{Action: "start", Package: "pkg"},
+				goTestEvent{Action: "output", Package: "pkg", Output: "FAIL\tpkg [build failed]\n"},
+				goTestEvent{Action: "fail", Package: "pkg", FailedBuild: "pkg [pkg.test]"},
+			),
+			wantOutput: "pkg/a.go:1: bad\nFAIL\tpkg [build failed]\n",
+			wantCases: []wantCase{{
+				pkg: "pkg", name: goTestPackageCase, status: reportFailed,
+				output: "pkg/a.go:1: bad\nFAIL\tpkg [build failed]\n",
+			}},
+		},
+		{
+			name: "PanicOutsideOfTest",
+			input: goTestJSON(t,
+				goTestEvent{Action: "run", Package: "pkg", Test: "TestA"},
+				goTestEvent{Action: "pass", Package: "pkg", Test: "TestA"},
+				goTestEvent{Action: "output", Package: "pkg", Output: "panic: init\n"},
+				goTestEvent{Action: "fail", Package: "pkg"},
+			),
+			wantOutput: "panic: init\n",
+			wantCases: []wantCase{
+				{pkg: "pkg", name: "TestA", status: reportSuccess},
+				{pkg: "pkg", name: goTestPackageCase, status: reportFailed, output: "panic: init\n"},
+			},
+		},
+		{
+			name:       "NonJSONLines",
+			input:      "not json\n{not json either\n",
+			wantOutput: "not json\n{not json either\n",
+		},
+		{
+			name:       "UnterminatedLine",
+			input:      "no newline",
+			wantOutput: "no newline\n",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			w := &goTestJSONWriter{
+				out:    &out,
+				cases:  map[string]*goTestCase{},
+				pkgs:   map[string]*goTestCase{},
+				builds: map[string]*strings.Builder{},
+			}
+			// The input is written a few bytes at a time to make sure lines
+			// that are split across writes are handled.
+			for input := tc.input; len(input) > 0; {
+				n := min(len(input), 7)
+				w.Write([]byte(input[:n]))
+				input = input[n:]
+			}
+			w.Close()
+
+			if out.String() != tc.wantOutput {
+				t.Errorf("Expected output %q, got %q", tc.wantOutput, out.String())
+			}
+			if len(w.order) != len(tc.wantCases) {
+				t.Fatalf("Expected %d cases, got %d", len(tc.wantCases), len(w.order))
+			}
+			for i, want := range tc.wantCases {
+				got := w.order[i]
+				if got.pkg != want.pkg || got.name != want.name ||
+					got.status != want.status || got.output.String() != want.output {
+					t.Errorf(
+						"Expected case %d to be %+v, got {pkg:%s name:%s status:%s output:%q}",
+						i, want, got.pkg, got.name, got.status, got.output.String(),
+					)
+				}
+			}
+		})
+	}
+}
+
+func TestNewJUnitTestCaseStripsColor(t *testing.T) {
+	c := newJUnitTestCase(
+		"target", "stage", 0, reportFailed,
+		"\x1b[31mfailed\x1b[0m",
+		"\x1b[1;36m[target:stage]\x1b[0m output\n",
+	)
+	if c.SystemOut != "[target:stage] output\n" {
+		t.Errorf("Expected the color to be removed from the output, got %q", c.SystemOut)
+	}
+	if c.Failure == nil || c.Failure.Message != "failed" {
+		t.Errorf("Expected the color to be removed from the failure, got %+v", c.Failure)
+	}
+}
@@ -0,0 +1,205 @@
+package sbbs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// The keys of the attributes the build system adds to the log records it
+	// passes to the log handlers. The target and stage attributes are added to
+	// any record that is logged while running a stage, the duration attribute
+	// is added to the record that reports a stage finishing, and the status
+	// attribute is added to records that report a success, a skip, or a panic
+	// with the values success, skipped, and panic respectively.
+	LogTargetKey   = "target"
+	LogStageKey    = "stage"
+	LogDurationKey = "duration"
+	LogStatusKey   = "status"
+
+	statusSuccess = "success"
+	statusSkipped = "skipped"
+	statusPanic   = "panic"
+
+	// The prefix that is printed on every line written by a console handler.
+	consoleLogPrefix = "smoothbrain-bs | "
+)
+
+type (
+	// A log handler that writes records in the same human readable format
+	// that the build system has always used. See [NewConsoleLogHandler].
+	consoleHandler struct {
+		w     io.Writer
+		color bool
+	}
+
+	stageKey    struct{}
+	logAttrsKey struct{}
+)
+
+var logHandlers atomic.Pointer[[]slog.Handler]
+
+func init() {
+	SetLogHandlers(NewConsoleLogHandler(os.Stderr))
+}
+
+// Sets the handlers that all log messages are sent to, replacing the current
+// handlers. By default log messages are only sent to a console handler that
+// writes to stderr. This allows logs to be emitted in other formats, such as
+// JSON lines with [slog.NewJSONHandler], or to be captured in tests. Each
+// handler decides which records it will handle, so the log level set with
+// [SetLogLevel] and [Target.LogLevel] only applies to console handlers.
+// Supplying no handlers disables logging.
+func SetLogHandlers(handlers ...slog.Handler) {
+	logHandlers.Store(&handlers)
+}
+
+// Adds a handler that log messages are sent to in addition to the current
+// handlers, such as writing the logs to a file as well as to the console. See
+// [SetLogHandlers].
+func AddLogHandler(h slog.Handler) {
+	for {
+		cur := logHandlers.Load()
+		handlers := append(append([]slog.Handler{}, *cur...), h)
+		if logHandlers.CompareAndSwap(cur, &handlers) {
+			return
+		}
+	}
+}
+
+// Creates a log handler that writes records to the supplied writer in the
+// human readable format used by the console. Only the message of each record
+// is written, multi-line messages are split across several lines, and the
+// record is only handled if its level is at or above the log level that
+// applies to it, see [SetLogLevel] and [Target.LogLevel]. Messages are only
+// colored when the writer is stderr and color is enabled, see [SetColorMode].
+func NewConsoleLogHandler(w io.Writer) slog.Handler {
+	return &consoleHandler{w: w, color: w == os.Stderr}
+}
+
+func (h *consoleHandler) Enabled(ctxt context.Context, level slog.Level) bool {
+	return LogLevel(level) >= ctxtLogLevel(ctxt)
+}
+
+func (h *consoleHandler) Handle(ctxt context.Context, r slog.Record) error {
+	status := ""
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == LogStatusKey {
+			status = a.Value.String()
+			return false
+		}
+		return true
+	})
+	color := consoleColor(LogLevel(r.Level), status)
+
+	prefix := consoleLogPrefix
+	if !r.Time.IsZero() {
+		prefix += r.Time.Format("2006/01/02 15:04:05 ")
+	}
+	var buf bytes.Buffer
+	for i, line := range bytes.Split([]byte(r.Message), []byte("\n")) {
+		buf.WriteString(prefix)
+		if i > 0 {
+			buf.WriteString(multiLineIndent)
+		}
+		if h.color {
+			buf.WriteString(colorize(color, string(line)))
+		} else {
+			buf.Write(line)
+		}
+		buf.WriteByte('\n')
+	}
+
+	consoleMu.Lock()
+	defer consoleMu.Unlock()
+	_, err := h.w.Write(buf.Bytes())
+	return err
+}
+
+// The console only prints the message of each record, so attributes and groups
+// are ignored.
+func (h *consoleHandler) WithAttrs(attrs []slog.Attr) slog.Handler { return h }
+func (h *consoleHandler) WithGroup(name string) slog.Handler       { return h }
+
+// Returns the color a record is printed in by a console handler.
+func consoleColor(level LogLevel, status string) string {
+	switch status {
+	case statusSuccess:
+		return colorSuccess
+	case statusSkipped:
+		return colorSkip
+	case statusPanic:
+		return colorPanic
+	}
+	switch {
+	case level >= LevelError:
+		return colorErr
+	case level >= LevelWarn:
+		return colorWarn
+	case level >= LevelInfo:
+		return colorInfo
+	}
+	return colorQuietInfo
+}
+
+// Returns a context that adds the supplied attributes to any records that are
+// logged with it.
+func withLogAttrs(ctxt context.Context, attrs ...slog.Attr) context.Context {
+	if prev, ok := ctxt.Value(logAttrsKey{}).([]slog.Attr); ok {
+		attrs = append(append([]slog.Attr{}, prev...), attrs...)
+	}
+	return context.WithValue(ctxt, logAttrsKey{}, attrs)
+}
+
+// Sends a record with the supplied message to every log handler that is
+// enabled for the records level. The target and stage the context belongs to
+// are added as attributes. When force is true the handlers are not asked if
+// they are enabled, so the record is always handled.
+func logRecord(
+	ctxt context.Context,
+	level LogLevel,
+	status string,
+	force bool,
+	msg string,
+) {
+	r := slog.NewRecord(time.Now(), slog.Level(level), msg, 0)
+	if run, ok := ctxt.Value(targetRunKey{}).(*targetRun); ok {
+		r.AddAttrs(slog.String(LogTargetKey, run.name))
+	}
+	if stage, ok := ctxt.Value(stageKey{}).(string); ok {
+		r.AddAttrs(slog.String(LogStageKey, stage))
+	}
+	if attrs, ok := ctxt.Value(logAttrsKey{}).([]slog.Attr); ok {
+		r.AddAttrs(attrs...)
+	}
+	if status != "" {
+		r.AddAttrs(slog.String(LogStatusKey, status))
+	}
+	// Messages logged by a stage are captured along with its console output
+	// so that they can be included in the JUnit report.
+	if s := junitOutput(ctxt); s != nil && level >= LevelInfo {
+		s.output.Write([]byte(msg + "\n"))
+	}
+
+	var errs []error
+	for _, h := range *logHandlers.Load() {
+		if force || h.Enabled(ctxt, r.Level) {
+			errs = append(errs, h.Handle(ctxt, r.Clone()))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		// There is nowhere else to report the error, so it is written
+		// directly to stderr rather than being lost.
+		consoleMu.Lock()
+		os.Stderr.WriteString(
+			consoleLogPrefix + "Could not log message: " + err.Error() + "\n",
+		)
+		consoleMu.Unlock()
+	}
+}
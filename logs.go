@@ -1,10 +1,11 @@
 package sbbs
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"os"
 	"strings"
+	"sync/atomic"
 )
 
 const (
@@ -19,55 +20,202 @@ const (
 
 	// The color code to restore the consoles default colors.
 	noColor = "\u001b[0m"
+
+	colorInfo      = "\u001b[36m"
+	colorQuietInfo = "\u001b[90m"
+	colorSuccess   = "\u001b[32m"
+	colorSkip      = "\u001b[35m"
+	colorWarn      = "\u001b[33m"
+	colorErr       = "\u001b[31m"
+	colorPanic     = "\u001b[1m\u001b[31m"
+
+	// The env variable that sets the log level when running [Main]. Valid
+	// values are debug, info, warn, and error. The `-v` and `-q` flags take
+	// precedence over this env variable.
+	LogLevelEnvVar = "SBBS_LOG_LEVEL"
+)
+
+// The severity of a log message. Messages below the current log level are not
+// printed. The values match those of the [log/slog] package.
+type LogLevel int
+
+const (
+	// Detailed information about what the build system is doing, such as the
+	// commands that are being run.
+	LevelDebug LogLevel = -4
+	// General progress information, such as stages starting and finishing.
+	// This is the default log level.
+	LevelInfo LogLevel = 0
+	// Problems that do not stop the build.
+	LevelWarn LogLevel = 4
+	// Problems that stop the build.
+	LevelError LogLevel = 8
 )
 
-// Logs messages, splitting multi-line message into the following format:
+type logLevelKey struct{}
+
+var logLevel atomic.Int64
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+// Parses a log level from its name, which is one of debug, info, warn, or
+// error. Case is ignored.
+func ParseLogLevel(name string) (LogLevel, error) {
+	for _, l := range []LogLevel{LevelDebug, LevelInfo, LevelWarn, LevelError} {
+		if strings.EqualFold(name, l.String()) {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf(
+		"Invalid log level '%s', expected one of: debug, info, warn, error", name,
+	)
+}
+
+// Sets the minimum level that log messages must have to be printed. This
+// applies to all log messages that are not part of a target with its own log
+// level. See [Target.LogLevel]. Only console log handlers respect the log
+// level, other handlers filter records based on their own options. See
+// [SetLogHandlers].
+func SetLogLevel(l LogLevel) {
+	logLevel.Store(int64(l))
+}
+
+func globalLogLevel() LogLevel {
+	return LogLevel(logLevel.Load())
+}
+
+// Returns the log level that applies to the stage that was given the supplied
+// context, falling back to the global log level.
+func ctxtLogLevel(ctxt context.Context) LogLevel {
+	if l, ok := ctxt.Value(logLevelKey{}).(LogLevel); ok {
+		return l
+	}
+	return globalLogLevel()
+}
+
+// Sets the minimum level that log messages about the targets stages must have
+// to be printed, overriding the global log level. This allows a noisy target
+// to be quietened, or a target that is being debugged to be made verbose,
+// without affecting the other targets. Only messages logged by the build system
+// itself, such as stages starting and commands being run, and messages logged
+// with the context aware log functions, such as [LogInfoContext], are
+// affected.
+func (t *Target) LogLevel(l LogLevel) *Target {
+	t.logLevel = &l
+	return t
+}
+
+// Formats the message and sends it to the log handlers. Multi-line messages
+// are sent as a single record, which console handlers print in the following
+// format:
 //
 //	<log data> <log line 1>
 //	<log data>  |> <log line 2>
 //	<log data>  |> <log line 3>
 //	<log data>  ...
-func multiLineLog(color string, fmtStr string, args ...any) {
+func logAt(
+	ctxt context.Context,
+	level LogLevel,
+	status string,
+	fmtStr string,
+	args ...any,
+) {
 	// This is a dumb hack to get arround any errors that look like the following:
 	// bs/bs.go:20:17: non-constant format string in call to github.com/barbell-math/smoothbrain-bs.LogErr
 	// See also: https://github.com/kubernetes/kubernetes/issues/127191
 	_fmtStr := fmtStr
 
-	str := fmt.Sprintf(_fmtStr, args...)
-	lines := strings.Split(str, "\n")
-	log.Printf(color + lines[0] + noColor)
-	for i := 1; i < len(lines); i++ {
-		log.Printf(multiLineIndent + color + lines[i] + noColor)
-	}
+	logRecord(ctxt, level, status, false, fmt.Sprintf(_fmtStr, args...))
 }
 
-// Logs info in cyan.
+// Logs info in cyan at the [LevelInfo] level.
 func LogInfo(fmt string, args ...any) {
-	multiLineLog("\u001b[36m", fmt, args...)
+	logAt(context.Background(), LevelInfo, "", fmt, args...)
 }
 
-// Logs quiet info in gray.
+// Logs quiet info in gray at the [LevelDebug] level, meaning it is only shown
+// when verbose logging is enabled.
 func LogQuietInfo(fmt string, args ...any) {
-	multiLineLog("\u001b[90m", fmt, args...)
+	logAt(context.Background(), LevelDebug, "", fmt, args...)
 }
 
-// Logs successes in green.
+// Logs successes in green at the [LevelInfo] level.
 func LogSuccess(fmt string, args ...any) {
-	multiLineLog("\u001b[32m", fmt, args...)
+	logAt(context.Background(), LevelInfo, statusSuccess, fmt, args...)
+}
+
+// Logs skipped operations in magenta at the [LevelInfo] level.
+func LogSkip(fmt string, args ...any) {
+	logAt(context.Background(), LevelInfo, statusSkipped, fmt, args...)
 }
 
-// Logs warnings in yellow.
+// Logs warnings in yellow at the [LevelWarn] level.
 func LogWarn(fmt string, args ...any) {
-	multiLineLog("\u001b[33m", fmt, args...)
+	logAt(context.Background(), LevelWarn, "", fmt, args...)
 }
 
-// Logs errors in red.
+// Logs errors in red at the [LevelError] level.
 func LogErr(fmt string, args ...any) {
-	multiLineLog("\u001b[31m", fmt, args...)
+	logAt(context.Background(), LevelError, "", fmt, args...)
 }
 
-// Logs errors in bold red and exits.
-func LogPanic(fmt string, args ...any) {
-	multiLineLog("\u001b[1m\u001b[31m", fmt, args...)
+// Logs errors in bold red and exits. The message is always logged.
+func LogPanic(fmtStr string, args ...any) {
+	_fmtStr := fmtStr
+	logRecord(
+		context.Background(), LevelError, statusPanic, true,
+		fmt.Sprintf(_fmtStr, args...),
+	)
 	os.Exit(1)
 }
+
+// Logs info in cyan at the [LevelInfo] level. Unlike [LogInfo] the message is
+// logged at the log level of the target the supplied context was given to, see
+// [Target.LogLevel], and the target and stage are added to the log record as
+// attributes. Messages logged by a stage are also included in the stages
+// output in the JUnit report.
+func LogInfoContext(ctxt context.Context, fmt string, args ...any) {
+	logAt(ctxt, LevelInfo, "", fmt, args...)
+}
+
+// Logs quiet info in gray at the [LevelDebug] level using the supplied
+// context, see [LogInfoContext].
+func LogQuietInfoContext(ctxt context.Context, fmt string, args ...any) {
+	logAt(ctxt, LevelDebug, "", fmt, args...)
+}
+
+// Logs successes in green at the [LevelInfo] level using the supplied context,
+// see [LogInfoContext].
+func LogSuccessContext(ctxt context.Context, fmt string, args ...any) {
+	logAt(ctxt, LevelInfo, statusSuccess, fmt, args...)
+}
+
+// Logs skipped operations in magenta at the [LevelInfo] level using the
+// supplied context, see [LogInfoContext].
+func LogSkipContext(ctxt context.Context, fmt string, args ...any) {
+	logAt(ctxt, LevelInfo, statusSkipped, fmt, args...)
+}
+
+// Logs warnings in yellow at the [LevelWarn] level using the supplied context,
+// see [LogInfoContext].
+func LogWarnContext(ctxt context.Context, fmt string, args ...any) {
+	logAt(ctxt, LevelWarn, "", fmt, args...)
+}
+
+// Logs errors in red at the [LevelError] level using the supplied context, see
+// [LogInfoContext].
+func LogErrContext(ctxt context.Context, fmt string, args ...any) {
+	logAt(ctxt, LevelError, "", fmt, args...)
+}
@@ -0,0 +1,197 @@
+package sbbs
+
+import (
+	"bytes"
+	"context"
+	"hash/fnv"
+	"io"
+	"os"
+	"sync"
+)
+
+// The colors that are used to prefix the output of concurrently running
+// stages. Red and yellow are not included so that output is not mistaken for
+// errors or warnings.
+var prefixColors = []string{
+	"\u001b[36m", "\u001b[32m", "\u001b[35m", "\u001b[34m",
+	"\u001b[96m", "\u001b[92m", "\u001b[95m", "\u001b[94m",
+}
+
+// Guards writing to the console so that output from concurrently running
+// commands, and the output of buffered stages, is never interleaved.
+var consoleMu sync.Mutex
+
+type (
+	// Controls how the console output of the commands run by a single stage
+	// is written. Output is written a line at a time, optionally prefixed
+	// with the name of the target and stage, or buffered until the stage
+	// finishes.
+	stageOutput struct {
+		prefix   string
+		buffered bool
+
+		mu      sync.Mutex
+		pending []outputLine
+	}
+
+	// A single line of output and where it should be written to.
+	outputLine struct {
+		dst  io.Writer
+		line []byte
+	}
+
+	// A writer that splits the output of a single stream, such as a commands
+	// stdout, into lines that are written through a stage output.
+	lineWriter struct {
+		out     *stageOutput
+		dst     io.Writer
+		partial []byte
+	}
+
+	stageOutputKey  struct{}
+	bufferOutputKey struct{}
+	parallelKey     struct{}
+)
+
+// Creates a stage that buffers the console output of every command the
+// supplied stage runs, printing all of it at once when the stage finishes.
+// This keeps the output of a stage together when it is run concurrently with
+// other stages, at the cost of not seeing the output as it is produced.
+func BufferOutput(stage Stager) Stager {
+	return wrapStage(func(ctxt context.Context, cmdLineArgs ...string) error {
+		return stage.Run(
+			context.WithValue(ctxt, bufferOutputKey{}, true), cmdLineArgs...,
+		)
+	}, stage)
+}
+
+// Returns true if the stage that was given the supplied context may be running
+// at the same time as other stages.
+func runningConcurrently(ctxt context.Context) bool {
+	if _, ok := ctxt.Value(parallelKey{}).(bool); ok {
+		return true
+	}
+	inv, ok := getInvocation(ctxt)
+	return ok && cap(inv.jobs) > 1
+}
+
+// Returns a context that determines how the console output of the commands run
+// by the named stage is written, along with the stage output that must be
+// flushed once the stage finishes. Output is prefixed with the target and
+// stage name when the stage may be running concurrently with other stages.
+func withStageOutput(
+	ctxt context.Context,
+	stage string,
+) (context.Context, *stageOutput) {
+	out := &stageOutput{}
+	out.buffered, _ = ctxt.Value(bufferOutputKey{}).(bool)
+	if runningConcurrently(ctxt) {
+		name := stage
+		if r, ok := ctxt.Value(targetRunKey{}).(*targetRun); ok {
+			name = r.name + ":" + stage
+		}
+		h := fnv.New32a()
+		h.Write([]byte(name))
+		color := prefixColors[h.Sum32()%uint32(len(prefixColors))]
+		out.prefix = colorize(color, "["+name+"]") + " "
+	}
+	// The buffer flag only applies to the stage it was given to, not to any
+	// stages that are nested within it.
+	ctxt = context.WithValue(ctxt, bufferOutputKey{}, false)
+	return context.WithValue(ctxt, stageOutputKey{}, out), out
+}
+
+// Returns a writer that writes to the supplied console stream, such as
+// [os.Stdout], using the output settings of the stage that was given the
+// supplied context. The returned writer must be closed once nothing else will
+// be written to it so that any partially written line is written.
+func consoleWriter(ctxt context.Context, dst io.Writer) io.WriteCloser {
+	var rv io.WriteCloser = nopWriteCloser{dst}
+	out, ok := ctxt.Value(stageOutputKey{}).(*stageOutput)
+	if ok && (out.prefix != "" || out.buffered) {
+		rv = &lineWriter{out: out, dst: dst}
+	}
+	// The output is also captured in the stages report, without the prefix,
+	// so that it can be included in the JUnit report.
+	if s := junitOutput(ctxt); s != nil {
+		rv = captureWriter{WriteCloser: rv, capture: &s.output}
+	}
+	return rv
+}
+
+// Returns a writer that can be used by a stage to write to stdout with the same
+// prefixing and buffering that is applied to the commands the stage runs. The
+// returned writer must be closed once the stage is done writing to it.
+func StageStdout(ctxt context.Context) io.WriteCloser {
+	return consoleWriter(ctxt, os.Stdout)
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.out.write(w.dst, w.partial[:i+1])
+		w.partial = w.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *lineWriter) Close() error {
+	if len(w.partial) > 0 {
+		w.out.write(w.dst, append(w.partial, '\n'))
+		w.partial = nil
+	}
+	return nil
+}
+
+func (o *stageOutput) write(dst io.Writer, line []byte) {
+	prefixed := make([]byte, 0, len(o.prefix)+len(line))
+	prefixed = append(append(prefixed, o.prefix...), line...)
+	if o.buffered {
+		o.mu.Lock()
+		o.pending = append(o.pending, outputLine{dst: dst, line: prefixed})
+		o.mu.Unlock()
+		return
+	}
+	consoleMu.Lock()
+	dst.Write(prefixed)
+	consoleMu.Unlock()
+}
+
+// Writes all of the buffered output at once.
+func (o *stageOutput) flush() {
+	o.mu.Lock()
+	pending := o.pending
+	o.pending = nil
+	o.mu.Unlock()
+
+	consoleMu.Lock()
+	defer consoleMu.Unlock()
+	for _, l := range pending {
+		l.dst.Write(l.line)
+	}
+}
+
+type (
+	nopWriteCloser struct {
+		io.Writer
+	}
+
+	// A writer that copies everything written to it to the capture writer.
+	captureWriter struct {
+		io.WriteCloser
+		capture io.Writer
+	}
+)
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func (w captureWriter) Write(p []byte) (int, error) {
+	w.capture.Write(p)
+	return w.WriteCloser.Write(p)
+}
@@ -0,0 +1,20 @@
+//go:build !unix
+
+package sbbs
+
+import "os/exec"
+
+// Process groups are only supported on unix systems, so on other platforms the
+// command is killed as soon as its context is cancelled.
+func setCancelSignals(cmd *exec.Cmd) (stop func()) {
+	return func() {}
+}
+
+// Running commands are only tracked on unix systems, where they are run in
+// their own process groups.
+func trackCmd(cmd *exec.Cmd) (untrack func()) {
+	return func() {}
+}
+
+// Commands are not tracked on other platforms, so there is nothing to kill.
+func killRunningCmds() {}
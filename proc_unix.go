@@ -0,0 +1,96 @@
+//go:build unix
+
+package sbbs
+
+import (
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The commands that are currently running, keyed by the id that signals are
+// sent to in order to stop them. Negative ids identify a process group.
+var runningCmds = struct {
+	sync.Mutex
+	ids map[int]struct{}
+}{ids: map[int]struct{}{}}
+
+// Runs the supplied command in its own process group and sets it up to be
+// stopped when its context is cancelled. The whole process group is sent
+// SIGTERM, followed by SIGKILL once the [CancelGracePeriod] has passed. The
+// returned function must be called once the command has exited. If the
+// command was cancelled it kills any processes that are left in the process
+// group, rather than leaving them to run until the grace period is over.
+//
+// Processes outside of the terminals foreground process group are stopped by
+// SIGTTIN when they read from the terminal, so a command that reads stdin from
+// a terminal is left in the build systems process group instead. Such a
+// command receives Ctrl-C from the terminal directly and only the command
+// itself, not the processes it started, is signalled when it is cancelled.
+func setCancelSignals(cmd *exec.Cmd) (stop func()) {
+	var timer *time.Timer
+	foreground := readsTerminal(cmd)
+	if !foreground {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
+	cmd.Cancel = func() error {
+		id := signalID(cmd)
+		timer = time.AfterFunc(CancelGracePeriod, func() {
+			syscall.Kill(id, syscall.SIGKILL)
+		})
+		return syscall.Kill(id, syscall.SIGTERM)
+	}
+	return func() {
+		if timer != nil && timer.Stop() && !foreground {
+			syscall.Kill(signalID(cmd), syscall.SIGKILL)
+		}
+	}
+}
+
+// Records that the supplied command has started so that it can be killed by
+// [killRunningCmds]. The returned function must be called once the command has
+// exited.
+func trackCmd(cmd *exec.Cmd) (untrack func()) {
+	id := signalID(cmd)
+	runningCmds.Lock()
+	runningCmds.ids[id] = struct{}{}
+	runningCmds.Unlock()
+	return func() {
+		runningCmds.Lock()
+		delete(runningCmds.ids, id)
+		runningCmds.Unlock()
+	}
+}
+
+// Sends SIGKILL to every command that is running, along with the processes in
+// their process groups. This is used when the build system has to exit
+// without waiting for the commands to stop, which would otherwise leave them
+// running because they do not receive signals from the terminal.
+func killRunningCmds() {
+	runningCmds.Lock()
+	defer runningCmds.Unlock()
+	for id := range runningCmds.ids {
+		syscall.Kill(id, syscall.SIGKILL)
+	}
+}
+
+// Returns the id that signals are sent to in order to stop the supplied
+// command, which is the id of its process group if it has one.
+func signalID(cmd *exec.Cmd) int {
+	if cmd.SysProcAttr != nil && cmd.SysProcAttr.Setpgid {
+		return -cmd.Process.Pid
+	}
+	return cmd.Process.Pid
+}
+
+// Returns true if the supplied command reads stdin from a terminal.
+func readsTerminal(cmd *exec.Cmd) bool {
+	f, ok := cmd.Stdin.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
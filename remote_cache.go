@@ -0,0 +1,217 @@
+package sbbs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// The env variable that enables the remote build cache. The value is the
+	// base URL of a server that responds to GET and PUT requests, such as a
+	// plain file server. Cache entries are stored under `<url>/entries/` and
+	// the files they reference are stored under `<url>/blobs/`.
+	RemoteCacheURLEnvVar = "SBBS_REMOTE_CACHE_URL"
+	// The env variable that controls if the remote build cache is written to.
+	// By default the remote cache is only read from. Setting this to true
+	// allows, for example, CI to populate the cache for developers to use.
+	RemoteCacheWriteEnvVar = "SBBS_REMOTE_CACHE_WRITE"
+)
+
+// A build cache that is shared through a HTTP server. All files are downloaded
+// into the local cache before being restored, and the content of every
+// downloaded file is checked against its hash. Only outputs with paths that are
+// relative to the current working directory can be restored from the remote
+// cache.
+type remoteCache struct {
+	baseURL *url.URL
+	client  *http.Client
+	write   bool
+}
+
+// Opens the remote cache, using the env variables to determine its location
+// and if it can be written to. A nil cache is returned if the remote cache is
+// not enabled.
+func openRemoteCache() (*remoteCache, error) {
+	rawURL, ok := os.LookupEnv(RemoteCacheURLEnvVar)
+	if !ok || rawURL == "" {
+		return nil, nil
+	}
+	baseURL, err := url.Parse(strings.TrimSuffix(rawURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid value for %s: %w", RemoteCacheURLEnvVar, err)
+	}
+
+	rv := &remoteCache{
+		baseURL: baseURL,
+		client:  &http.Client{Timeout: 5 * time.Minute},
+	}
+	if write, ok := os.LookupEnv(RemoteCacheWriteEnvVar); ok {
+		if rv.write, err = strconv.ParseBool(write); err != nil {
+			return nil, fmt.Errorf(
+				"Invalid value for %s: %w", RemoteCacheWriteEnvVar, err,
+			)
+		}
+	}
+	return rv, nil
+}
+
+func (r *remoteCache) blobURL(hash string) string {
+	return r.baseURL.JoinPath("blobs", hash).String()
+}
+
+func (r *remoteCache) entryURL(key string) string {
+	return r.baseURL.JoinPath("entries", key+".json").String()
+}
+
+// Performs a request against the remote cache, returning the response if the
+// server responded with a 2xx status code. A nil response and nil error are
+// returned if the server responded to a GET or HEAD request with a 404 status
+// code.
+func (r *remoteCache) do(
+	ctxt context.Context,
+	method string,
+	url string,
+	body []byte,
+) (*http.Response, error) {
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctxt, method, url, bodyReader)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound && method != http.MethodPut {
+		resp.Body.Close()
+		return nil, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: unexpected status: %s", method, url, resp.Status)
+	}
+	return resp, nil
+}
+
+// Downloads the entry with the supplied key, and all the files it references,
+// into the local cache. Returns false if the entry is not present in the
+// remote cache.
+func (r *remoteCache) fetch(
+	ctxt context.Context,
+	c *localCache,
+	key string,
+) (bool, error) {
+	resp, err := r.do(ctxt, http.MethodGet, r.entryURL(key), nil)
+	if err != nil || resp == nil {
+		return false, err
+	}
+	var m cacheManifest
+	err = json.NewDecoder(resp.Body).Decode(&m)
+	resp.Body.Close()
+	if err != nil {
+		return false, fmt.Errorf("Malformed cache entry %s: %w", key, err)
+	}
+	if m.Key != key {
+		return false, fmt.Errorf(
+			"Cache entry %s does not match its key, got %s", key, m.Key,
+		)
+	}
+
+	for _, f := range m.Files {
+		// The manifest came from outside of this machine, make sure it cannot
+		// be used to write files outside of the current working directory.
+		if !filepath.IsLocal(f.Path) {
+			return false, fmt.Errorf(
+				"Cache entry %s contains a non-local path: %s", key, f.Path,
+			)
+		}
+		if _, err := hex.DecodeString(f.Hash); err != nil || len(f.Hash) != sha256.Size*2 {
+			return false, fmt.Errorf(
+				"Cache entry %s contains an invalid hash: %s", key, f.Hash,
+			)
+		}
+	}
+	temps := map[string]string{}
+	defer removeTemps(temps)
+	for _, f := range m.Files {
+		if _, ok := temps[f.Hash]; ok || c.hasBlob(f.Hash) {
+			continue
+		}
+		resp, err := r.do(ctxt, http.MethodGet, r.blobURL(f.Hash), nil)
+		if err != nil || resp == nil {
+			return false, err
+		}
+		tmp, hash, err := c.writeTemp(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return false, err
+		}
+		temps[f.Hash] = tmp
+		if hash != f.Hash {
+			return false, fmt.Errorf(
+				"Blob content does not match its hash: %s", f.Hash,
+			)
+		}
+	}
+	return true, c.commit(m, temps)
+}
+
+// Uploads the supplied entry, and all the files it references, to the remote
+// cache. Files that are already present in the remote cache are not uploaded
+// again. The entry is uploaded last so that it is never visible before all of
+// its files are.
+func (r *remoteCache) push(
+	ctxt context.Context,
+	c *localCache,
+	m cacheManifest,
+) error {
+	for _, f := range m.Files {
+		resp, err := r.do(ctxt, http.MethodHead, r.blobURL(f.Hash), nil)
+		if err != nil {
+			return err
+		}
+		if resp != nil {
+			resp.Body.Close()
+			continue
+		}
+
+		data, err := os.ReadFile(c.blobPath(f.Hash))
+		if err != nil {
+			return err
+		}
+		if resp, err = r.do(
+			ctxt, http.MethodPut, r.blobURL(f.Hash), data,
+		); err != nil {
+			return err
+		} else if resp != nil {
+			resp.Body.Close()
+		}
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	resp, err := r.do(ctxt, http.MethodPut, r.entryURL(m.Key), data)
+	if err != nil {
+		return err
+	} else if resp != nil {
+		resp.Body.Close()
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package sbbs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// An in memory file server that the remote cache can read from and write to.
+type fakeRemote struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	puts  []string
+}
+
+func newFakeRemote(t *testing.T) (*fakeRemote, *httptest.Server) {
+	f := &fakeRemote{files: map[string][]byte{}}
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			switch req.Method {
+			case http.MethodGet, http.MethodHead:
+				data, ok := f.files[req.URL.Path]
+				if !ok {
+					http.NotFound(w, req)
+					return
+				}
+				w.Write(data)
+			case http.MethodPut:
+				data, err := io.ReadAll(req.Body)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				f.files[req.URL.Path] = data
+				f.puts = append(f.puts, req.URL.Path)
+			default:
+				http.Error(w, "", http.StatusMethodNotAllowed)
+			}
+		},
+	))
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeRemote) set(path string, data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.files[path] = data
+}
+
+func (f *fakeRemote) numPuts() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.puts)
+}
+
+// Opens a remote cache that uses the supplied server, along with an empty
+// local cache.
+func newTestCaches(
+	t *testing.T,
+	srv *httptest.Server,
+) (*remoteCache, *localCache) {
+	t.Setenv(RemoteCacheURLEnvVar, srv.URL)
+	t.Setenv(CacheDirEnvVar, t.TempDir())
+	remote, err := openRemoteCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := openLocalCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return remote, c
+}
+
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+func TestRemoteCacheRoundTrip(t *testing.T) {
+	t.Chdir(t.TempDir())
+	_, srv := newFakeRemote(t)
+	if err := os.WriteFile("out.txt", []byte("generated"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	remote, c := newTestCaches(t, srv)
+	m, err := c.store("key", []string{"out.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.push(context.Background(), c, m); err != nil {
+		t.Fatalf("Could not push: %s", err)
+	}
+	if err := os.Remove("out.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second local cache starts empty, so everything must come from the
+	// remote cache.
+	remote, c = newTestCaches(t, srv)
+	ok, err := remote.fetch(context.Background(), c, "key")
+	if err != nil || !ok {
+		t.Fatalf("Expected the entry to be fetched, got %t, %v", ok, err)
+	}
+	restored, err := c.restore("key")
+	if err != nil || restored != 1 {
+		t.Fatalf("Expected 1 restored file, got %d, %v", restored, err)
+	}
+	data, err := os.ReadFile("out.txt")
+	if err != nil || string(data) != "generated" {
+		t.Fatalf("Expected the restored file to match, got %q, %v", data, err)
+	}
+}
+
+func TestRemoteCacheMiss(t *testing.T) {
+	_, srv := newFakeRemote(t)
+	remote, c := newTestCaches(t, srv)
+	ok, err := remote.fetch(context.Background(), c, "missing")
+	if err != nil || ok {
+		t.Fatalf("Expected a miss, got %t, %v", ok, err)
+	}
+}
+
+func TestRemoteCacheRejectsBadEntries(t *testing.T) {
+	content := []byte("generated")
+	tests := []struct {
+		name    string
+		files   []cacheFile
+		blob    []byte
+		wantErr string
+	}{
+		{
+			name:    "HashMismatch",
+			files:   []cacheFile{{Path: "out.txt", Hash: sha256Hex(content)}},
+			blob:    []byte("tampered"),
+			wantErr: "Blob content does not match its hash",
+		},
+		{
+			name:    "ParentPath",
+			files:   []cacheFile{{Path: "../out.txt", Hash: sha256Hex(content)}},
+			blob:    content,
+			wantErr: "contains a non-local path",
+		},
+		{
+			name:    "AbsolutePath",
+			files:   []cacheFile{{Path: "/tmp/out.txt", Hash: sha256Hex(content)}},
+			blob:    content,
+			wantErr: "contains a non-local path",
+		},
+		{
+			name:    "InvalidHash",
+			files:   []cacheFile{{Path: "out.txt", Hash: "../../entries/x"}},
+			blob:    content,
+			wantErr: "contains an invalid hash",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			f, srv := newFakeRemote(t)
+			remote, c := newTestCaches(t, srv)
+			data, err := json.Marshal(cacheManifest{Key: "key", Files: tc.files})
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.set("/entries/key.json", data)
+			for _, file := range tc.files {
+				f.set("/blobs/"+file.Hash, tc.blob)
+			}
+
+			ok, err := remote.fetch(context.Background(), c, "key")
+			if ok || err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("Expected error containing %q, got %t, %v", tc.wantErr, ok, err)
+			}
+			if m, _ := c.manifest("key"); m != nil {
+				t.Fatal("Expected the rejected entry to not be stored locally")
+			}
+			for _, file := range tc.files {
+				if c.hasBlob(file.Hash) {
+					t.Fatal("Expected the rejected blob to not be stored locally")
+				}
+			}
+			if tmps, _ := os.ReadDir(filepath.Join(c.dir, "tmp")); len(tmps) > 0 {
+				t.Fatalf("Expected no temporary files to be left, got %d", len(tmps))
+			}
+		})
+	}
+}
+
+func TestRemoteCacheWriteGating(t *testing.T) {
+	tests := []struct {
+		name      string
+		write     string
+		wantPuts  bool
+		wantError bool
+	}{
+		{name: "Unset", write: "", wantPuts: false},
+		{name: "False", write: "false", wantPuts: false},
+		{name: "True", write: "true", wantPuts: true},
+		{name: "Invalid", write: "sometimes", wantError: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			quietLogs(t)
+			t.Chdir(t.TempDir())
+			f, srv := newFakeRemote(t)
+			t.Setenv(RemoteCacheURLEnvVar, srv.URL)
+			t.Setenv(CacheDirEnvVar, t.TempDir())
+			if tc.write != "" {
+				t.Setenv(RemoteCacheWriteEnvVar, tc.write)
+			}
+
+			b := NewBuildSystem()
+			b.RegisterTarget(context.Background(), "gen", Cached(
+				CacheOpts{Outputs: []string{"out.txt"}},
+				Stage(
+					"Generate",
+					func(ctxt context.Context, cmdLineArgs ...string) error {
+						return os.WriteFile("out.txt", []byte("generated"), 0o644)
+					},
+				),
+			))
+			err := b.RunTarget(context.Background(), "gen")
+			if tc.wantError {
+				if err == nil || !strings.Contains(err.Error(), RemoteCacheWriteEnvVar) {
+					t.Fatalf("Expected an invalid value error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if gotPuts := f.numPuts() > 0; gotPuts != tc.wantPuts {
+				t.Fatalf(
+					"Expected the remote cache to be written to: %t, got %d puts",
+					tc.wantPuts, f.numPuts(),
+				)
+			}
+		})
+	}
+}
@@ -0,0 +1,260 @@
+package sbbs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"runtime"
+	"time"
+)
+
+// The statuses that are used in a build report.
+const (
+	reportSuccess   = "success"
+	reportFailed    = "failed"
+	reportSkipped   = "skipped"
+	reportCancelled = "cancelled"
+)
+
+type (
+	// The report that is written by the `-report` flag, see [Main]. The
+	// report is intended to be consumed by other tools, so the field names
+	// must not be changed.
+	buildReport struct {
+		Program  string         `json:"program"`
+		Args     []string       `json:"args"`
+		Start    time.Time      `json:"start"`
+		End      time.Time      `json:"end"`
+		Duration int64          `json:"durationMs"`
+		Status   string         `json:"status"`
+		Error    string         `json:"error,omitempty"`
+		Env      reportEnv      `json:"env"`
+		Targets  []targetReport `json:"targets"`
+	}
+
+	// Information about the environment the build was run in.
+	reportEnv struct {
+		GoVersion   string `json:"goVersion"`
+		OS          string `json:"os"`
+		Arch        string `json:"arch"`
+		GitRevision string `json:"gitRevision,omitempty"`
+	}
+
+	targetReport struct {
+		Name       string         `json:"name"`
+		Start      time.Time      `json:"start,omitzero"`
+		End        time.Time      `json:"end,omitzero"`
+		Duration   int64          `json:"durationMs"`
+		Status     string         `json:"status"`
+		Error      string         `json:"error,omitempty"`
+		SkipReason string         `json:"skipReason,omitempty"`
+		Stages     []*stageReport `json:"stages"`
+	}
+
+	// A single run of a stage. Stages that are retried have a report for
+	// every attempt.
+	stageReport struct {
+		Name       string          `json:"name"`
+		Start      time.Time       `json:"start"`
+		End        time.Time       `json:"end"`
+		Duration   int64           `json:"durationMs"`
+		Status     string          `json:"status"`
+		Error      string          `json:"error,omitempty"`
+		SkipReason string          `json:"skipReason,omitempty"`
+		Commands   []commandReport `json:"commands"`
+
+		// Everything the stage printed to the console, along with the
+		// messages it logged, which is included in the JUnit report.
+		output lockedBuffer
+		// The results of any go tests the stage ran, see [RunGoTest].
+		tests []*goTestCase
+	}
+
+	commandReport struct {
+		Cmdline  string    `json:"cmdline"`
+		Start    time.Time `json:"start"`
+		Duration int64     `json:"durationMs"`
+		ExitCode int       `json:"exitCode"`
+		Error    string    `json:"error,omitempty"`
+	}
+
+	stageReportKey struct{}
+)
+
+// Returns the status that describes the supplied error, which was returned by
+// an operation that was given the supplied context. Operations that were
+// stopped because something else failed or Ctrl-C was pressed are considered
+// cancelled, whereas operations that ran out of time are considered failed.
+func reportStatus(ctxt context.Context, err error) string {
+	if err == nil {
+		return reportSuccess
+	}
+	cause := context.Cause(ctxt)
+	if cause == nil || !errors.Is(err, cause) {
+		return reportFailed
+	}
+	if _, ok := cause.(TimeoutError); ok {
+		return reportFailed
+	}
+	return reportCancelled
+}
+
+// Adds a report for a stage that started at the supplied time to the target
+// that is running it. Nil is returned if the stage is not being run as part of
+// a target, in which case there is nowhere to record it.
+func recordStage(
+	ctxt context.Context,
+	name string,
+	start time.Time,
+) *stageReport {
+	r, ok := ctxt.Value(targetRunKey{}).(*targetRun)
+	inv, invOk := getInvocation(ctxt)
+	if !ok || !invOk {
+		return nil
+	}
+	sr := &stageReport{Name: name, Start: start, Commands: []commandReport{}}
+	inv.mu.Lock()
+	r.stages = append(r.stages, sr)
+	inv.mu.Unlock()
+	return sr
+}
+
+// Records that the stage finished with the supplied status and error.
+func (s *stageReport) finish(ctxt context.Context, status string, err error) {
+	inv, ok := getInvocation(ctxt)
+	if s == nil || !ok {
+		return
+	}
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	s.End = time.Now()
+	s.Duration = s.End.Sub(s.Start).Milliseconds()
+	s.Status = status
+	if err != nil {
+		s.Error = err.Error()
+	}
+}
+
+// Returns the report of the stage that was given the supplied context, if any.
+func getStageReport(ctxt context.Context) *stageReport {
+	s, _ := ctxt.Value(stageReportKey{}).(*stageReport)
+	return s
+}
+
+// Adds a report for the supplied command result to the stage that ran it, if
+// any.
+func recordCommand(ctxt context.Context, res *CmdResult, err error) {
+	s := getStageReport(ctxt)
+	inv, ok := getInvocation(ctxt)
+	if s == nil || !ok {
+		return
+	}
+	cr := commandReport{
+		Cmdline:  res.Cmdline,
+		Start:    time.Now().Add(-res.Duration),
+		Duration: res.Duration.Milliseconds(),
+		ExitCode: res.ExitCode,
+	}
+	if err != nil {
+		cr.Error = err.Error()
+	}
+	inv.mu.Lock()
+	s.Commands = append(s.Commands, cr)
+	inv.mu.Unlock()
+}
+
+// Returns the status of the target run for use in a build report.
+func (r *targetRun) reportStatus() string {
+	switch {
+	case r.cancelled:
+		return reportCancelled
+	case !r.started:
+		return reportSkipped
+	case r.err != nil:
+		return reportFailed
+	case r.skipped != "":
+		return reportSkipped
+	}
+	return reportSuccess
+}
+
+// Writes a report of the invocation to the supplied path as JSON. The report
+// includes every target that was run, in the order they were scheduled, along
+// with any requested targets that were never scheduled.
+func (inv *invocation) writeReport(
+	path string,
+	progName string,
+	args []string,
+	start time.Time,
+	reqs []targetRequest,
+	err error,
+) error {
+	rep := buildReport{
+		Program: progName,
+		Args:    args,
+		Start:   start,
+		End:     time.Now(),
+		Status:  reportSuccess,
+		Env:     newReportEnv(),
+		Targets: []targetReport{},
+	}
+	rep.Duration = rep.End.Sub(rep.Start).Milliseconds()
+	if errors.Is(err, InterruptErr) {
+		rep.Status = reportCancelled
+	} else if err != nil {
+		rep.Status = reportFailed
+	}
+	if err != nil {
+		rep.Error = err.Error()
+	}
+
+	inv.mu.Lock()
+	for _, r := range inv.order {
+		tr := targetReport{
+			Name:       r.name,
+			Start:      r.start,
+			End:        r.end,
+			Duration:   r.end.Sub(r.start).Milliseconds(),
+			Status:     r.reportStatus(),
+			SkipReason: r.skipped,
+			Stages:     append([]*stageReport{}, r.stages...),
+		}
+		if r.err != nil {
+			tr.Error = r.err.Error()
+		}
+		rep.Targets = append(rep.Targets, tr)
+	}
+	for _, req := range reqs {
+		if _, ok := inv.runs[req.name]; !ok {
+			rep.Targets = append(rep.Targets, targetReport{
+				Name:   req.name,
+				Status: reportSkipped,
+				Stages: []*stageReport{},
+			})
+		}
+	}
+	data, marshalErr := json.MarshalIndent(rep, "", "\t")
+	inv.mu.Unlock()
+	if marshalErr != nil {
+		return marshalErr
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// Gathers information about the environment the build is running in. The git
+// revision is left empty when not running inside a git repository.
+func newReportEnv() reportEnv {
+	rv := reportEnv{
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+	}
+	res, err := Cmd("git", "rev-parse", "HEAD").
+		Stderr(StderrCapture).
+		Run(context.Background())
+	if err == nil {
+		rv.GitRevision = res.TrimmedOutput()
+	}
+	return rv
+}
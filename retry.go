@@ -0,0 +1,99 @@
+package sbbs
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// The number of attempts a retried stage is given if none is specified.
+	defaultRetryAttempts = 3
+	// The delay before the first retry if none is specified.
+	defaultRetryDelay = time.Second
+	// The fraction each delay is randomly increased or decreased by so that
+	// concurrent retries, such as those from separate CI jobs, do not happen
+	// in lock step.
+	retryJitter = 0.25
+)
+
+// Defines how a stage is retried when it fails. See [Retry].
+type RetryOpts struct {
+	// The maximum number of times the stage will be run, including the first
+	// attempt. Defaults to 3 if not set.
+	Attempts int
+	// The delay before the first retry, which is doubled after every failed
+	// attempt. Defaults to 1 second if not set.
+	Delay time.Duration
+	// The upper limit on the delay between attempts. No limit is applied if
+	// not set.
+	MaxDelay time.Duration
+	// Returns true if the supplied error should be retried. Defaults to
+	// retrying every error except [StopErr], which is returned when a stage
+	// has already reported the problem and retrying would not help.
+	ShouldRetry func(err error) bool
+}
+
+// Creates a stage that runs the supplied stage again if it fails, waiting
+// longer between each attempt. This is intended for stages that fail
+// intermittently, such as those that access the network. Each delay is
+// randomized slightly and the stage is never retried once its context is done,
+// such as after a timeout or when Ctrl-C is pressed.
+func Retry(opts RetryOpts, stage Stager) Stager {
+	if opts.Attempts <= 0 {
+		opts.Attempts = defaultRetryAttempts
+	}
+	if opts.Delay <= 0 {
+		opts.Delay = defaultRetryDelay
+	}
+	if opts.ShouldRetry == nil {
+		opts.ShouldRetry = func(err error) bool {
+			return !errors.Is(err, StopErr)
+		}
+	}
+
+	name := strings.Join(stage.Names(), ", ")
+	return wrapStage(func(ctxt context.Context, cmdLineArgs ...string) error {
+		delay := opts.Delay
+		for attempt := 1; ; attempt++ {
+			err := stage.Run(ctxt, cmdLineArgs...)
+			if err == nil || attempt >= opts.Attempts ||
+				ctxt.Err() != nil || !opts.ShouldRetry(err) {
+				return err
+			}
+
+			jittered := time.Duration(
+				float64(delay) * (1 + retryJitter*(2*rand.Float64()-1)),
+			)
+			LogWarnContext(ctxt,
+				"Stage '%s': Attempt %d/%d failed, retrying in %s",
+				name, attempt, opts.Attempts, jittered.Round(time.Millisecond),
+			)
+			select {
+			case <-time.After(jittered):
+			case <-ctxt.Done():
+				return StageError{Stage: name, Err: context.Cause(ctxt)}
+			}
+
+			delay *= 2
+			if opts.MaxDelay > 0 {
+				delay = min(delay, opts.MaxDelay)
+			}
+		}
+	}, stage)
+}
+
+// Returns a function that can be used as [RetryOpts.ShouldRetry] to only retry
+// errors that were caused by a program exiting with one of the supplied exit
+// codes.
+func RetryOnExitCodes(codes ...int) func(err error) bool {
+	return func(err error) bool {
+		var exitErr *exec.ExitError
+		return errors.As(err, &exitErr) &&
+			slices.Contains(codes, exitErr.ExitCode())
+	}
+}
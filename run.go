@@ -1,17 +1,17 @@
 package sbbs
 
 import (
-	"bytes"
 	"context"
 	"io"
 	"os"
-	"os/exec"
-	"strings"
 )
 
 // Runs the program with the specified `args` using the supplied context. The
 // supplied pipe will be used to capture Stdout. Stderr will always be printed
-// to the console.
+// to the console and the end of it is included in the returned error if the
+// program fails. This is a shorthand for running a [Command] when its
+// [CmdResult] is not needed, see [Command.Stderr] for other ways to handle
+// stderr and [Command.Run] for how cancellation is handled.
 func RunCwd(
 	ctxt context.Context,
 	pipe io.Writer,
@@ -19,27 +19,8 @@ func RunCwd(
 	prog string,
 	args ...string,
 ) error {
-	var cmd *exec.Cmd
-	cmd = exec.CommandContext(ctxt, prog, args...)
-	cmd.Dir = cwd
-	cmd.Stdout = pipe
-	cmd.Stderr = os.Stderr
-
-	LogQuietInfo("Running: '%s'", cmd.String())
-	err := cmd.Run()
-	if err != nil {
-		return err
-	}
-
-	if cmd.ProcessState.ExitCode() != 0 {
-		LogErr(
-			"The process exited with a non-zero exit code: %d",
-			cmd.ProcessState.ExitCode(),
-		)
-		return StopErr
-	}
-
-	return nil
+	_, err := Cmd(prog, args...).Dir(cwd).Stdout(pipe).Run(ctxt)
+	return err
 }
 
 // Runs the program with the specified `args` using the supplied context in the
@@ -74,21 +55,39 @@ func RunStdout(ctxt context.Context, prog string, args ...string) error {
 	return RunCwd(ctxt, os.Stdout, "", prog, args...)
 }
 
+// Runs the supplied target in the [DefaultBuildSystem], unless the supplied
+// context was given to a stage by a different build system, in which case the
+// target is run in that build system. See [BuildSystem.RunTarget].
+func RunTarget(ctxt context.Context, target string, cmdLineArgs ...string) error {
+	if inv, ok := getInvocation(ctxt); ok {
+		return inv.bs.RunTarget(ctxt, target, cmdLineArgs...)
+	}
+	return DefaultBuildSystem.RunTarget(ctxt, target, cmdLineArgs...)
+}
+
 // Runs the supplied target, given that the supplied target is present in the
-// build systems target list. Execution of all further targets/stages will stop
-// if running the supplied target fails.
-func RunTarget(ctxt context.Context, target string, cmdLineArgs ...string) {
-	if _, ok := targets[target]; !ok {
-		LogPanic("Unrecognized target: %s", target)
+// build systems target list. All of the targets dependencies will be run before
+// the target itself. If the supplied context was given to a stage by the build
+// system then any targets that have already been run as part of the current
+// invocation will not be run again. The returned error will be a
+// [TargetError] identifying the target and stage that failed.
+func (b *BuildSystem) RunTarget(
+	ctxt context.Context,
+	target string,
+	cmdLineArgs ...string,
+) error {
+	inv, ok := getInvocation(ctxt)
+	if !ok || inv.bs != b {
+		return newInvocation(b, ctxt, 1).runTarget(nil, target, cmdLineArgs...)
 	}
-	targets[target](cmdLineArgs...)
+	caller, _ := ctxt.Value(targetRunKey{}).(*targetRun)
+	return inv.runTarget(caller, target, cmdLineArgs...)
 }
 
 // A helpful utility function that runs `git rev-parse --show-toplevel` and
 // returns the stdout. This is often useful when attempting to change the
 // current working directory to a repositories root directory.
 func GitRevParse(ctxt context.Context) (string, error) {
-	var buf bytes.Buffer
-	err := Run(ctxt, &buf, "git", "rev-parse", "--show-toplevel")
-	return strings.TrimSpace(buf.String()), err
+	res, err := Cmd("git", "rev-parse", "--show-toplevel").Run(ctxt)
+	return res.TrimmedOutput(), err
 }
@@ -3,48 +3,104 @@ package sbbs
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"sync"
 	"time"
 )
 
+// Calls the function.
+func (s StageFunc) Run(ctxt context.Context, cmdLineArgs ...string) error {
+	return s(ctxt, cmdLineArgs...)
+}
+
+// Returns a single name that marks the stage as unnamed, since a plain function
+// has no name.
+func (s StageFunc) Names() []string {
+	return []string{unnamedStage}
+}
+
 // Creates a stage that can be added to a build target. Stages define the
 // operations that will take place when a build target is executing. The
 // supplied context can be modified and passed to [Run] functions to
 // deterministically control how long various operations take. This prevents
-// builds from hanging forever.
+// builds from hanging forever. If the context is cancelled, such as when Ctrl-C
+// is pressed or another target fails, the stage waits for the operation to
+// return before returning the cancellation cause, so operations should stop
+// promptly once their context is done. Any cleanup functions the operation
+// registered with [AddCleanup] are run once it returns. When the stage may be
+// running concurrently with other stages the console output of any commands
+// it runs is prefixed with the target and stage name, see [BufferOutput] for
+// keeping a stages output together instead.
 func Stage(
 	name string,
 	op func(ctxt context.Context, cmdLineArgs ...string) error,
-) StageFunc {
-	return func(ctxt context.Context, cmdLineArgs ...string) error {
+) Stager {
+	return nameStage(func(ctxt context.Context, cmdLineArgs ...string) error {
 		start := time.Now()
-		LogInfo("Starting '%s' stage...", name)
+		ctxt = context.WithValue(ctxt, stageKey{}, name)
+		report := recordStage(ctxt, name, start)
+		LogInfoContext(ctxt, "Starting '%s' stage...", name)
 
 		doneCh := make(chan error)
 		go func() {
-			doneCh <- op(ctxt, cmdLineArgs...)
+			opCtxt := context.WithValue(ctxt, stageReportKey{}, report)
+			opCtxt, out := withStageOutput(opCtxt, name)
+			opCtxt, cleanups := withCleanupScope(opCtxt)
+			err := op(opCtxt, cmdLineArgs...)
+			if cleanupErr := cleanups.run(); cleanupErr != nil {
+				err = errors.Join(err, cleanupErr)
+			}
+			out.flush()
+			doneCh <- err
 		}()
 
 		select {
 		case err := <-doneCh:
+			delta := time.Since(start)
+			doneCtxt := withLogAttrs(ctxt, slog.Duration(LogDurationKey, delta))
 			if err == nil {
-				LogSuccess("Stage '%s': Completed Successfully", name)
+				LogSuccessContext(doneCtxt, "Stage '%s': Completed Successfully", name)
 			} else {
-				LogErr("Stage '%s': Encountered an error: %s", name, err)
+				LogErrContext(doneCtxt, "Stage '%s': Encountered an error: %s", name, err)
 			}
-			LogQuietInfo(multiLineIndent+"Time Delta: %s", time.Now().Sub(start))
-			return err
+			LogQuietInfoContext(ctxt, multiLineIndent+"Time Delta: %s", delta)
+			report.finish(ctxt, reportStatus(ctxt, err), err)
+			if err != nil {
+				return StageError{Stage: name, Err: err}
+			}
+			return nil
 		case <-ctxt.Done():
-			LogErr("Stage '%s': Encountered an error: %s", name, ctxt.Err())
-			return ctxt.Err()
+			// The op is always waited on so that it, and any processes it
+			// started, cannot outlive the stage. Any error it returns is most
+			// likely a result of being cancelled, so the cancellation cause
+			// is reported instead unless the error already contains it, such
+			// as when a nested stage was cancelled.
+			cause := context.Cause(ctxt)
+			LogWarnContext(ctxt, "Stage '%s': Cancelled, waiting for it to stop: %s", name, cause)
+			err := <-doneCh
+			if !errors.Is(err, cause) {
+				err = cause
+			}
+			delta := time.Since(start)
+			doneCtxt := withLogAttrs(ctxt, slog.Duration(LogDurationKey, delta))
+			if _, ok := cause.(TimeoutError); ok {
+				LogErrContext(doneCtxt, "Stage '%s': Timed out: %s", name, cause)
+			} else {
+				LogErrContext(doneCtxt, "Stage '%s': Encountered an error: %s", name, cause)
+			}
+			LogQuietInfoContext(ctxt, multiLineIndent+"Time Delta: %s", delta)
+			report.finish(ctxt, reportStatus(ctxt, err), err)
+			return StageError{Stage: name, Err: err}
 		}
-	}
+	}, []string{name}, nil)
 }
 
 // Changes the current working directory to the repositories root directory if
 // the current working directory is inside a repo. Results in an error if the
 // current working directory is not inside a repo.
-func CdToRepoRoot() StageFunc {
+func CdToRepoRoot() Stager {
 	return Stage(
 		"cd to repo root",
 		func(ctxt context.Context, cmdLineArgs ...string) error {
@@ -59,23 +115,62 @@ func CdToRepoRoot() StageFunc {
 }
 
 // Runs the supplied target as though it were a stage, given that the supplied
-// target is preset in the build systems target list. Execution of all further
-// targets/stages will stop if running the supplied target fails.
-func TargetAsStage(target string) StageFunc {
-	return Stage(
+// target is preset in the target list of the build system that is running the
+// stage. This is checked when the build system is started by [Main], along
+// with checking that the target does not end up running the target the stage
+// belongs to. If the target has already been run as part of the current
+// invocation it will not be run again. Execution of all further targets/stages
+// will stop if running the supplied target fails.
+func TargetAsStage(target string) Stager {
+	s := Stage(
 		fmt.Sprintf("target:%s", target),
 		func(ctxt context.Context, cmdLineArgs ...string) error {
-			RunTarget(ctxt, target, cmdLineArgs...)
-			return nil
+			return RunTarget(ctxt, target, cmdLineArgs...)
+		},
+	)
+	return nameStage(s.Run, s.Names(), []string{target})
+}
+
+// Creates a stage that runs all of the supplied stages concurrently. If any of
+// the stages fail the context given to the remaining stages will be cancelled
+// and the first error that was encountered will be returned once all of the
+// stages have stopped. Stages that are run concurrently should not rely on
+// process wide state such as the current working directory.
+func ParallelStages(name string, stages ...Stager) Stager {
+	s := Stage(
+		name,
+		func(ctxt context.Context, cmdLineArgs ...string) error {
+			ctxt, cancel := context.WithCancelCause(ctxt)
+			defer cancel(nil)
+			ctxt = context.WithValue(ctxt, parallelKey{}, true)
+
+			var wg sync.WaitGroup
+			var once sync.Once
+			var firstErr error
+			for i := range stages {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if err := stages[i].Run(ctxt, cmdLineArgs...); err != nil {
+						once.Do(func() {
+							firstErr = err
+							cancel(err)
+						})
+					}
+				}()
+			}
+			wg.Wait()
+			return firstErr
 		},
 	)
+	return nameStage(s.Run, s.Names(), stageTargets(stages...))
 }
 
 // Runs git diff on the current directory and if any output is returned prints
 // the given error message, the diff result, and suggests a target to run to fix
 // the issue if `targetToRun` is not an empty string. An error will be returned
 // if the diff returns any a non-empty result.
-func GitDiffStage(errMessage string, targetToRun string) StageFunc {
+func GitDiffStage(errMessage string, targetToRun string) Stager {
 	return Stage(
 		"Run Diff",
 		func(ctxt context.Context, cmdLineArgs ...string) error {
@@ -84,10 +179,10 @@ func GitDiffStage(errMessage string, targetToRun string) StageFunc {
 				return err
 			}
 			if buf.Len() > 0 {
-				LogErr(errMessage)
-				LogQuietInfo(buf.String())
+				LogErrContext(ctxt, "%s", errMessage)
+				LogInfoContext(ctxt, "%s", buf.String())
 				if targetToRun != "" {
-					LogErr(
+					LogErrContext(ctxt,
 						"Run build system with %s and push any changes",
 						targetToRun,
 					)
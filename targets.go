@@ -4,15 +4,21 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"os"
 	"os/user"
 	"path"
 	"strings"
 )
 
+// Calls [BuildSystem.RegisterBsBuildTarget] on the [DefaultBuildSystem].
+func RegisterBsBuildTarget() {
+	DefaultBuildSystem.RegisterBsBuildTarget()
+}
+
 // Registers a target that rebuilds the build system. This is often useful when
 // changes are made to the build system of a project.
-func RegisterBsBuildTarget() {
-	RegisterTarget(
+func (b *BuildSystem) RegisterBsBuildTarget() {
+	b.RegisterTarget(
 		context.Background(),
 		"buildbs",
 		Stage(
@@ -21,33 +27,35 @@ func RegisterBsBuildTarget() {
 				return RunStdout(ctxt, "go", "build", "-o", "./bs/bs", "./bs")
 			},
 		),
-	)
+	).Description("Rebuilds the build system").
+		Category("Build System")
+}
+
+// Calls [BuildSystem.RegisterUpdateDepsTarget] on the [DefaultBuildSystem].
+func RegisterUpdateDepsTarget() {
+	DefaultBuildSystem.RegisterUpdateDepsTarget()
 }
 
 // Registers a target that updates all dependences. Dependencies that are in
 // the `barbell-math` repo will always be pinned at latest and all other
 // dependencies will be updated to the latest version.
-func RegisterUpdateDepsTarget() {
-	RegisterTarget(
+func (b *BuildSystem) RegisterUpdateDepsTarget() {
+	b.RegisterTarget(
 		context.Background(),
 		"updateDeps",
 		CdToRepoRoot(),
-		Stage(
+		// Fetching packages fails intermittently due to network issues, and
+		// go does not use distinct exit codes for them, so any error is
+		// retried.
+		Retry(RetryOpts{}, Stage(
 			"barbell-math package updates",
 			func(ctxt context.Context, cmdLineArgs ...string) error {
-				var packages bytes.Buffer
-				if err := Run(
-					ctxt, &packages, "go", "list", "-m", "-u", "all",
-				); err != nil {
-					return err
-				}
-
-				reset, err := TmpEnvVarSet("GOPROXY", "direct")
+				packages, err := Cmd("go", "list", "-m", "-u", "all").Run(ctxt)
 				if err != nil {
 					return err
 				}
 
-				lines := strings.Split(packages.String(), "\n")
+				lines := packages.Lines()
 				// First line is the current package, skip it
 				for i := 1; i < len(lines); i++ {
 					iterPackage := strings.SplitN(lines[i], " ", 2)
@@ -58,17 +66,18 @@ func RegisterUpdateDepsTarget() {
 						continue
 					}
 
-					if err := RunStdout(
-						ctxt, "go", "get", iterPackage[0]+"@latest",
-					); err != nil {
+					if _, err := Cmd("go", "get", iterPackage[0]+"@latest").
+						Env("GOPROXY", "direct").
+						Stdout(os.Stdout).
+						Run(ctxt); err != nil {
 						return err
 					}
 				}
 
-				return reset()
+				return nil
 			},
-		),
-		Stage(
+		)),
+		Retry(RetryOpts{}, Stage(
 			"Non barbell-math package updates",
 			func(ctxt context.Context, cmdLineArgs ...string) error {
 				if err := RunStdout(ctxt, "go", "get", "-u", "./..."); err != nil {
@@ -80,7 +89,7 @@ func RegisterUpdateDepsTarget() {
 
 				return nil
 			},
-		),
+		)),
 		Stage(
 			"Check if bs updated",
 			func(ctxt context.Context, cmdLineArgs ...string) error {
@@ -94,20 +103,26 @@ func RegisterUpdateDepsTarget() {
 					strings.TrimSpace(buf.String()),
 					"github.com/barbell-math/smoothbrain-bs",
 				) {
-					LogWarn("The build system package was upgraded!")
-					LogWarn("It is recommended to rebuild your projects build system after this command completes.")
+					LogWarnContext(ctxt, "The build system package was upgraded!")
+					LogWarnContext(ctxt, "It is recommended to rebuild your projects build system after this command completes.")
 				}
 				return nil
 			},
 		),
-	)
+	).Description("Updates all dependencies to their latest versions").
+		Category("Dependencies")
+}
+
+// Calls [BuildSystem.RegisterGoMarkDocTargets] on the [DefaultBuildSystem].
+func RegisterGoMarkDocTargets() {
+	DefaultBuildSystem.RegisterGoMarkDocTargets()
 }
 
 // Registers two targets:
 //  1. The first target will run gomarkdoc, embeding the results in README.md
 //  2. The second target will install gomarkdoc using go intstall
-func RegisterGoMarkDocTargets() {
-	RegisterTarget(
+func (b *BuildSystem) RegisterGoMarkDocTargets() {
+	b.RegisterTarget(
 		context.Background(),
 		"gomarkdocInstall",
 		CdToRepoRoot(),
@@ -120,9 +135,10 @@ func RegisterGoMarkDocTargets() {
 				)
 			},
 		),
-	)
+	).Description("Installs gomarkdoc using go install").
+		Category("Tools")
 
-	RegisterTarget(
+	b.RegisterTarget(
 		context.Background(),
 		"gomarkdocReadme",
 		CdToRepoRoot(),
@@ -136,20 +152,26 @@ func RegisterGoMarkDocTargets() {
 					"--output", "README.md", ".",
 				)
 				if err != nil {
-					LogQuietInfo("Consider running build system with gomarkdocInstall target if gomarkdoc is not installed")
+					LogQuietInfoContext(ctxt, "Consider running build system with gomarkdocInstall target if gomarkdoc is not installed")
 				}
 				return err
 			},
 		),
-	)
+	).Description("Runs gomarkdoc, embedding the results in README.md").
+		Category("Generate")
+}
+
+// Calls [BuildSystem.RegisterSqlcTargets] on the [DefaultBuildSystem].
+func RegisterSqlcTargets(pathInRepo string) {
+	DefaultBuildSystem.RegisterSqlcTargets(pathInRepo)
 }
 
 // Registers two targets:
 //  1. The first target will run sqlc generate in the provided path, relative to
 //     the repo root dir.
 //  2. The second target will install sqlc using go intstall
-func RegisterSqlcTargets(pathInRepo string) {
-	RegisterTarget(
+func (b *BuildSystem) RegisterSqlcTargets(pathInRepo string) {
+	b.RegisterTarget(
 		context.Background(),
 		"sqlc",
 		Stage(
@@ -168,13 +190,14 @@ func RegisterSqlcTargets(pathInRepo string) {
 			func(ctxt context.Context, cmdLineArgs ...string) error {
 				err := RunStdout(ctxt, "sqlc", "generate")
 				if err != nil {
-					LogQuietInfo("Consider running build system with sqlcInstall target if sqlc is not installed")
+					LogQuietInfoContext(ctxt, "Consider running build system with sqlcInstall target if sqlc is not installed")
 				}
 				return err
 			},
 		),
-	)
-	RegisterTarget(
+	).Description("Runs sqlc generate in " + pathInRepo).
+		Category("Generate")
+	b.RegisterTarget(
 		context.Background(),
 		"sqlcInstall",
 		Stage(
@@ -186,25 +209,37 @@ func RegisterSqlcTargets(pathInRepo string) {
 				)
 			},
 		),
-	)
+	).Description("Installs sqlc using go install").
+		Category("Tools")
+}
+
+// Retries curl when it exits with a code that indicates a problem that is
+// usually temporary, such as failing to resolve a host, timing out, or
+// receiving a HTTP error status.
+var curlRetryOpts = RetryOpts{
+	ShouldRetry: RetryOnExitCodes(6, 7, 22, 28, 35, 52, 56),
+}
+
+// Calls [BuildSystem.RegisterGoEnumTargets] on the [DefaultBuildSystem].
+func RegisterGoEnumTargets() {
+	DefaultBuildSystem.RegisterGoEnumTargets()
 }
 
 // Registers one target:
 //  1. The first target will run install go-enum in ~/go/bin
-func RegisterGoEnumTargets() {
-	RegisterTarget(
+func (b *BuildSystem) RegisterGoEnumTargets() {
+	b.RegisterTarget(
 		context.Background(),
 		"goenumInstall",
-		Stage(
+		Retry(curlRetryOpts, Stage(
 			"Install go-enum",
 			func(ctxt context.Context, cmdLineArgs ...string) error {
-				var unameS bytes.Buffer
-				var unameM bytes.Buffer
-
-				if err := Run(ctxt, &unameS, "uname", "-s"); err != nil {
+				unameS, err := Cmd("uname", "-s").Run(ctxt)
+				if err != nil {
 					return err
 				}
-				if err := Run(ctxt, &unameM, "uname", "-m"); err != nil {
+				unameM, err := Cmd("uname", "-m").Run(ctxt)
+				if err != nil {
 					return err
 				}
 
@@ -219,8 +254,8 @@ func RegisterGoEnumTargets() {
 					"curl", "-fsSL",
 					fmt.Sprintf(
 						"https://github.com/abice/go-enum/releases/download/v0.6.1/go-enum_%s_%s",
-						strings.TrimSpace(unameS.String()),
-						strings.TrimSpace(unameM.String()),
+						unameS.TrimmedOutput(),
+						unameM.TrimmedOutput(),
 					),
 					"-o", finalPath,
 				); err != nil {
@@ -229,8 +264,9 @@ func RegisterGoEnumTargets() {
 
 				return RunStdout(ctxt, "chmod", "+x", finalPath)
 			},
-		),
-	)
+		)),
+	).Description("Installs go-enum in ~/go/bin").
+		Category("Tools")
 }
 
 // Defines the available targets that can be added by
@@ -306,13 +342,18 @@ func (g *goTargets) SetBenchTarget(name string, args ...string) *goTargets {
 	return g
 }
 
+// Calls [BuildSystem.RegisterCommonGoCmdTargets] on the [DefaultBuildSystem].
+func RegisterCommonGoCmdTargets(g *goTargets) {
+	DefaultBuildSystem.RegisterCommonGoCmdTargets(g)
+}
+
 // Registers some common go cmds as targets. See the [MergegateTargets] struct
 // for details about the available targets that can be added.
-func RegisterCommonGoCmdTargets(g *goTargets) {
+func (b *BuildSystem) RegisterCommonGoCmdTargets(g *goTargets) {
 	if len(g.FmtArgs) > 0 && len(g.FmtTargetName) > 0 {
 		args := []string{"fmt"}
 		args = append(args, g.FmtArgs...)
-		RegisterTarget(
+		b.RegisterTarget(
 			context.Background(),
 			g.FmtTargetName,
 			CdToRepoRoot(),
@@ -322,13 +363,14 @@ func RegisterCommonGoCmdTargets(g *goTargets) {
 					return RunStdout(ctxt, "go", args...)
 				},
 			),
-		)
+		).Description("Runs go fmt").
+			Category("Go")
 	}
 
 	if len(g.GenerateArgs) > 0 && len(g.GenerateTargetName) > 0 {
 		args := []string{"generate"}
 		args = append(args, g.GenerateArgs...)
-		RegisterTarget(
+		b.RegisterTarget(
 			context.Background(),
 			g.GenerateTargetName,
 			CdToRepoRoot(),
@@ -338,39 +380,40 @@ func RegisterCommonGoCmdTargets(g *goTargets) {
 					return RunStdout(ctxt, "go", args...)
 				},
 			),
-		)
+		).Description("Runs go generate").
+			Category("Generate")
 	}
 
 	if len(g.TestArgs) > 0 && len(g.TestTargetName) > 0 {
-		args := []string{"test"}
-		args = append(args, g.TestArgs...)
-		RegisterTarget(
+		args := g.TestArgs
+		b.RegisterTarget(
 			context.Background(),
 			g.TestTargetName,
 			CdToRepoRoot(),
 			Stage(
 				"Run go test",
 				func(ctxt context.Context, cmdLineArgs ...string) error {
-					return RunStdout(ctxt, "go", args...)
+					return RunGoTest(ctxt, args...)
 				},
 			),
-		)
+		).Description("Runs go test").
+			Category("Go")
 	}
 
 	if len(g.BenchArgs) > 0 && len(g.BenchTargetName) > 0 {
-		args := []string{"test"}
-		args = append(args, g.BenchArgs...)
-		RegisterTarget(
+		args := g.BenchArgs
+		b.RegisterTarget(
 			context.Background(),
 			g.BenchTargetName,
 			CdToRepoRoot(),
 			Stage(
 				"Run go test",
 				func(ctxt context.Context, cmdLineArgs ...string) error {
-					return RunStdout(ctxt, "go", args...)
+					return RunGoTest(ctxt, args...)
 				},
 			),
-		)
+		).Description("Runs go test with benchmarks").
+			Category("Go")
 	}
 }
 
@@ -397,20 +440,25 @@ type MergegateTargets struct {
 	// Any stages that should be run prior to all other mergegate stages as
 	// defined by the other flags in this struct. Useful for installing
 	// dependencies that the other stages might rely upon.
-	PreStages []StageFunc
+	PreStages []Stager
 	// Any stages that should be run after all other mergegate stages as defined
 	// by the other flags in this struct. Useful for adding additional mergegate
 	// checks.
-	PostStages []StageFunc
+	PostStages []Stager
+}
+
+// Calls [BuildSystem.RegisterMergegateTarget] on the [DefaultBuildSystem].
+func RegisterMergegateTarget(a MergegateTargets) {
+	DefaultBuildSystem.RegisterMergegateTarget(a)
 }
 
 // Registers a mergegate target that will perform the actions that are defined
 // by the [MergegateTargets] struct. See the [MergegateTargets] struct for
 // details about the available stages the mergegate target can run.
-func RegisterMergegateTarget(a MergegateTargets) {
+func (b *BuildSystem) RegisterMergegateTarget(a MergegateTargets) {
 	// Generate a stage that runs `git diff` and returns an error if there are any
 	// differences.
-	stages := []StageFunc{}
+	stages := []Stager{}
 	stages = append(stages, a.PreStages...)
 	if len(a.FmtTarget) > 0 {
 		stages = append(
@@ -449,5 +497,61 @@ func RegisterMergegateTarget(a MergegateTargets) {
 	}
 	stages = append(stages, a.PostStages...)
 
-	RegisterTarget(context.Background(), "mergegate", stages...)
+	b.RegisterTarget(context.Background(), "mergegate", stages...).
+		Description("Runs all of the checks that must pass before merging").
+		Category("CI")
+}
+
+// Calls [BuildSystem.RegisterCacheTarget] on the [DefaultBuildSystem].
+func RegisterCacheTarget() {
+	DefaultBuildSystem.RegisterCacheTarget()
+}
+
+// Registers a target that manages the local build cache used by [Cached]
+// stages. The target accepts one of the following sub commands:
+//  1. stats: prints the location, size, and number of entries in the cache
+//  2. clean: removes all entries from the cache
+func (b *BuildSystem) RegisterCacheTarget() {
+	b.RegisterTarget(
+		context.Background(),
+		"cache",
+		Stage(
+			"Manage build cache",
+			func(ctxt context.Context, cmdLineArgs ...string) error {
+				c, err := openLocalCache()
+				if err != nil {
+					return err
+				}
+				if len(cmdLineArgs) != 1 {
+					LogErrContext(ctxt, "Expected exactly one of: stats, clean")
+					return StopErr
+				}
+
+				switch cmdLineArgs[0] {
+				case "stats":
+					stats, err := c.stats()
+					if err != nil {
+						return err
+					}
+					LogInfoContext(ctxt, "Cache Dir: %s", c.dir)
+					LogInfoContext(ctxt, "Entries: %d", stats.entries)
+					LogInfoContext(ctxt, "Blobs: %d", stats.blobs)
+					LogInfoContext(ctxt,
+						"Size: %s / %s",
+						formatByteSize(stats.size), formatByteSize(c.maxSize),
+					)
+					return nil
+				case "clean":
+					return c.clean()
+				default:
+					LogErrContext(ctxt, "Unrecognized cache command: %s", cmdLineArgs[0])
+					LogQuietInfoContext(ctxt, "Consider: Re-running with one of: stats, clean")
+					return StopErr
+				}
+			},
+		),
+	).
+		Description("Prints statistics about or cleans the build cache").
+		Usage("stats | clean").
+		Category("Build System")
 }
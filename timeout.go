@@ -0,0 +1,63 @@
+package sbbs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The cause given to a context when a target, stage, or the entire build runs
+// for longer than its timeout. This allows a stage that was stopped because it
+// ran out of time to be told apart from a stage that failed on its own. For
+// compatibility with code that checks for context deadlines a TimeoutError is
+// also considered to be [context.DeadlineExceeded] by [errors.Is].
+type TimeoutError struct {
+	// What timed out, such as "Target 'build'".
+	Scope   string
+	Timeout time.Duration
+}
+
+func (t TimeoutError) Error() string {
+	return fmt.Sprintf("%s exceeded its timeout of %s", t.Scope, t.Timeout)
+}
+
+func (t TimeoutError) Is(target error) bool {
+	return target == context.DeadlineExceeded
+}
+
+// Sets the maximum amount of time the target is allowed to run for. Once the
+// timeout has passed the context given to the targets stages is cancelled with
+// a [TimeoutError]. The timeout does not include the time spent running the
+// targets dependencies. A timeout of zero, which is the default, means the
+// target can run indefinitely.
+func (t *Target) Timeout(timeout time.Duration) *Target {
+	t.timeout = timeout
+	return t
+}
+
+// Creates a stage that cancels the context given to the supplied stage with a
+// [TimeoutError] if it runs for longer than the supplied timeout. The stage
+// will report that it timed out, as opposed to reporting a generic error.
+func Timeout(timeout time.Duration, stage Stager) Stager {
+	name := strings.Join(stage.Names(), ", ")
+	return wrapStage(func(ctxt context.Context, cmdLineArgs ...string) error {
+		ctxt, cancel := withTimeout(ctxt, fmt.Sprintf("Stage '%s'", name), timeout)
+		defer cancel()
+		return stage.Run(ctxt, cmdLineArgs...)
+	}, stage)
+}
+
+// Derives a context that is cancelled with a [TimeoutError] once the supplied
+// timeout has passed, logging the timeout so that it is clear what budget the
+// operation was given.
+func withTimeout(
+	ctxt context.Context,
+	scope string,
+	timeout time.Duration,
+) (context.Context, context.CancelFunc) {
+	LogQuietInfoContext(ctxt, "%s: Timeout of %s", scope, timeout)
+	return context.WithTimeoutCause(
+		ctxt, timeout, TimeoutError{Scope: scope, Timeout: timeout},
+	)
+}
@@ -0,0 +1,362 @@
+package sbbs
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// How long the watcher waits for more changes after a change is detected
+	// before rerunning the targets. This prevents bursts of changes, such as
+	// switching branches, from causing many reruns.
+	watchDebounce = 300 * time.Millisecond
+	// How often the polling watcher checks for changes.
+	watchPollInterval = time.Second
+)
+
+type (
+	// Reports paths that may have changed. Paths are slash separated and
+	// relative to the directory that is being watched.
+	fileWatcher interface {
+		changes() <-chan string
+		close() error
+	}
+
+	// The contents of every file that is being watched. This is used to filter
+	// out changes that did not modify a files contents, such as when a
+	// generator rewrites a file with identical contents.
+	watchSnapshot struct {
+		root   string
+		hashes map[string]string
+	}
+
+	// A watcher that periodically walks the watched directory, reporting any
+	// files whose size or modification time has changed.
+	pollWatcher struct {
+		root   string
+		ignore *gitignore
+		stats  map[string]fs.FileInfo
+		ch     chan string
+		done   chan struct{}
+	}
+)
+
+// An error used to cancel the current run when changes are detected.
+var errWatchRestart = errors.New("Changes were detected, restarting")
+
+// Walks the supplied root directory, calling the supplied function on every
+// file and directory that is not ignored. The paths given to the function are
+// slash separated and relative to the root directory.
+func walkWatched(
+	root string,
+	rel string,
+	ignore *gitignore,
+	op func(rel string, d fs.DirEntry) error,
+) error {
+	return filepath.WalkDir(
+		filepath.Join(root, filepath.FromSlash(rel)),
+		func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				// Files can be removed while walking, which is not an error.
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			iterRel, err := filepath.Rel(root, p)
+			if err != nil {
+				return err
+			}
+			iterRel = filepath.ToSlash(iterRel)
+			if iterRel != "." && ignore.ignored(iterRel, d.IsDir()) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if d.IsDir() {
+				ignore.loadDir(iterRel)
+			}
+			return op(iterRel, d)
+		},
+	)
+}
+
+func newWatchSnapshot(root string, ignore *gitignore) (*watchSnapshot, error) {
+	s := &watchSnapshot{root: root, hashes: map[string]string{}}
+	err := walkWatched(root, ".", ignore, func(rel string, d fs.DirEntry) error {
+		if !d.IsDir() && d.Type().IsRegular() {
+			s.update(rel)
+		}
+		return nil
+	})
+	return s, err
+}
+
+// Updates the snapshot with the current contents of the supplied file,
+// returning true if the files contents changed or if the file was added or
+// removed.
+func (s *watchSnapshot) update(rel string) bool {
+	prev, existed := s.hashes[rel]
+	p := filepath.Join(s.root, filepath.FromSlash(rel))
+	info, err := os.Stat(p)
+	if err != nil {
+		delete(s.hashes, rel)
+		return existed
+	}
+	if !info.Mode().IsRegular() {
+		return false
+	}
+	hash, err := hashFile(p)
+	if err != nil {
+		delete(s.hashes, rel)
+		return existed
+	}
+	s.hashes[rel] = hash
+	return !existed || prev != hash
+}
+
+func newPollWatcher(root string, ignore *gitignore) (*pollWatcher, error) {
+	w := &pollWatcher{
+		root:   root,
+		ignore: ignore,
+		ch:     make(chan string),
+		done:   make(chan struct{}),
+	}
+	var err error
+	if w.stats, err = w.scan(); err != nil {
+		return nil, err
+	}
+	go w.poll()
+	return w, nil
+}
+
+func (w *pollWatcher) scan() (map[string]fs.FileInfo, error) {
+	rv := map[string]fs.FileInfo{}
+	err := walkWatched(w.root, ".", w.ignore, func(rel string, d fs.DirEntry) error {
+		if !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				rv[rel] = info
+			}
+		}
+		return nil
+	})
+	return rv, err
+}
+
+func (w *pollWatcher) poll() {
+	defer close(w.ch)
+	ticker := time.NewTicker(watchPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+
+		stats, err := w.scan()
+		if err != nil {
+			LogWarn("Could not scan for changes: %s", err)
+			continue
+		}
+		changed := []string{}
+		for rel, info := range stats {
+			prev, ok := w.stats[rel]
+			if !ok || prev.Size() != info.Size() || !prev.ModTime().Equal(info.ModTime()) {
+				changed = append(changed, rel)
+			}
+		}
+		for rel := range w.stats {
+			if _, ok := stats[rel]; !ok {
+				changed = append(changed, rel)
+			}
+		}
+		w.stats = stats
+
+		for _, rel := range changed {
+			select {
+			case w.ch <- rel:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
+
+func (w *pollWatcher) changes() <-chan string {
+	return w.ch
+}
+
+func (w *pollWatcher) close() error {
+	close(w.done)
+	return nil
+}
+
+// Sends batches of changed files on the returned channel. A batch is sent once
+// no further changes have been detected for the debounce period. Paths that
+// were reported by the watcher but whose contents did not change are ignored.
+func debounceChanges(
+	w fileWatcher,
+	snapshot *watchSnapshot,
+) <-chan []string {
+	rv := make(chan []string)
+	go func() {
+		defer close(rv)
+		var changed []string
+		var timer <-chan time.Time
+		for {
+			select {
+			case rel, ok := <-w.changes():
+				if !ok {
+					return
+				}
+				if snapshot.update(rel) && !slices.Contains(changed, rel) {
+					changed = append(changed, rel)
+					timer = time.After(watchDebounce)
+				}
+			case <-timer:
+				rv <- changed
+				changed, timer = nil, nil
+			}
+		}
+	}()
+	return rv
+}
+
+// Runs the requested targets every time a file in the repository changes,
+// cancelling the current run if changes are detected before it finishes. Files
+// that are ignored by git are not watched. Changes are detected with inotify
+// where it is available, otherwise the repository is polled for changes. The
+// report, JUnit, and log files are not watched either, since they are written
+// by every run. This function only returns if the watcher fails or the
+// supplied context is cancelled.
+func (b *BuildSystem) watch(ctxt context.Context, opts runOpts) int {
+	cwd, err := os.Getwd()
+	if err != nil {
+		LogErr("Could not get the current working directory: %s", err)
+		return 1
+	}
+	root, err := GitRevParse(ctxt)
+	if err != nil || root == "" {
+		root = cwd
+	}
+
+	outputs := []string{}
+	for _, p := range []string{opts.report, opts.junit, opts.logJSON} {
+		if p == "" {
+			continue
+		}
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			continue
+		}
+		if rel, err := filepath.Rel(root, abs); err == nil && filepath.IsLocal(rel) {
+			outputs = append(outputs, filepath.ToSlash(rel))
+		}
+	}
+	ignore := newGitignore(root, outputs...)
+	snapshot, err := newWatchSnapshot(root, ignore)
+	if err != nil {
+		LogErr("Could not scan '%s' for changes: %s", root, err)
+		return 1
+	}
+	var w fileWatcher
+	if w, err = newNotifyWatcher(root, ignore); err != nil {
+		LogQuietInfo("Falling back to polling for changes: %s", err)
+		if w, err = newPollWatcher(root, ignore); err != nil {
+			LogErr("Could not watch '%s' for changes: %s", root, err)
+			return 1
+		}
+	}
+	defer w.close()
+	batches := debounceChanges(w, snapshot)
+	LogInfo("Watching '%s' for changes", root)
+
+	for {
+		// Stages often change the current working directory, which should
+		// not carry over between runs.
+		if err := os.Chdir(cwd); err != nil {
+			LogErr("Could not restore the current working directory: %s", err)
+			return 1
+		}
+
+		// The timeout is derived from the runs context, so it is also
+		// stopped whenever the run is cancelled.
+		runCtxt, cancel := context.WithCancelCause(ctxt)
+		cancelTimeout := context.CancelFunc(func() {})
+		if opts.timeout > 0 {
+			runCtxt, cancelTimeout = withTimeout(
+				runCtxt, "The build", opts.timeout,
+			)
+		}
+		start := time.Now()
+		inv := newInvocation(b, runCtxt, opts.jobs)
+		inv.force = opts.force
+		inv.junit = opts.junit != ""
+		done := make(chan error, 1)
+		go func() { done <- inv.runTargets(opts.reqs) }()
+
+		var changed []string
+		var ok bool
+		select {
+		case err := <-done:
+			if len(opts.reqs) > 1 {
+				inv.logSummary(opts.reqs)
+			}
+			if opts.report != "" {
+				if reportErr := inv.writeReport(
+					opts.report, opts.progName, opts.cmdLineArgs,
+					start, opts.reqs, err,
+				); reportErr != nil {
+					LogErr("Could not write the build report: %s", reportErr)
+				}
+			}
+			if opts.junit != "" {
+				if junitErr := inv.writeJUnit(
+					opts.junit, opts.progName, start, opts.reqs,
+				); junitErr != nil {
+					LogErr("Could not write the JUnit report: %s", junitErr)
+				}
+			}
+			if errors.Is(err, InterruptErr) {
+				cancel(nil)
+				logInterrupted(err)
+				return interruptedExitCode
+			} else if err != nil {
+				LogErr("An error was encountered: %s", err)
+			}
+			LogInfo("Waiting for changes...")
+			select {
+			case changed, ok = <-batches:
+			case <-ctxt.Done():
+				cancel(nil)
+				return interruptedExitCode
+			}
+		case changed, ok = <-batches:
+			LogWarn("Changes were detected, cancelling the current run")
+			cancel(errWatchRestart)
+			<-done
+		}
+		cancelTimeout()
+		cancel(nil)
+		if !ok {
+			LogErr("Stopped receiving changes from the file watcher")
+			return 1
+		}
+
+		const maxListed = 5
+		listed := changed[:min(len(changed), maxListed)]
+		if len(changed) > maxListed {
+			listed = append(slices.Clone(listed), "...")
+		}
+		LogInfo("Changed: %s", strings.Join(listed, ", "))
+	}
+}
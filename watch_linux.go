@@ -0,0 +1,134 @@
+//go:build linux
+
+package sbbs
+
+import (
+	"encoding/binary"
+	"io/fs"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+)
+
+const inotifyMask = syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE |
+	syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM |
+	syscall.IN_MOVED_TO
+
+// A watcher that uses inotify to detect changes. Every directory that is not
+// ignored is watched, including directories that are created after the watcher
+// is started.
+type notifyWatcher struct {
+	root   string
+	ignore *gitignore
+	fd     int
+	f      *os.File
+	ch     chan string
+
+	mu   sync.Mutex
+	dirs map[int32]string
+}
+
+func newNotifyWatcher(root string, ignore *gitignore) (fileWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	w := &notifyWatcher{
+		root:   root,
+		ignore: ignore,
+		fd:     fd,
+		// Wrapping the non-blocking descriptor in a file allows the runtime
+		// poller to be used, which means closing the file unblocks Read.
+		f:    os.NewFile(uintptr(fd), "inotify"),
+		ch:   make(chan string),
+		dirs: map[int32]string{},
+	}
+	if _, err := w.addTree("."); err != nil {
+		w.f.Close()
+		return nil, err
+	}
+	go w.read()
+	return w, nil
+}
+
+// Watches the supplied directory and every directory below it that is not
+// ignored, returning the files that were found.
+func (w *notifyWatcher) addTree(rel string) ([]string, error) {
+	files := []string{}
+	err := walkWatched(w.root, rel, w.ignore, func(iterRel string, d fs.DirEntry) error {
+		if !d.IsDir() {
+			files = append(files, iterRel)
+			return nil
+		}
+		wd, err := syscall.InotifyAddWatch(
+			w.fd, path.Join(w.root, iterRel), inotifyMask,
+		)
+		if err != nil {
+			return os.NewSyscallError("inotify_add_watch", err)
+		}
+		w.mu.Lock()
+		w.dirs[int32(wd)] = iterRel
+		w.mu.Unlock()
+		return nil
+	})
+	return files, err
+}
+
+func (w *notifyWatcher) read() {
+	defer close(w.ch)
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			wd := int32(binary.NativeEndian.Uint32(buf[off:]))
+			mask := binary.NativeEndian.Uint32(buf[off+4:])
+			nameLen := int(binary.NativeEndian.Uint32(buf[off+12:]))
+			nameStart := off + syscall.SizeofInotifyEvent
+			name := string(buf[nameStart : nameStart+nameLen])
+			for len(name) > 0 && name[len(name)-1] == 0 {
+				name = name[:len(name)-1]
+			}
+			off = nameStart + nameLen
+
+			w.mu.Lock()
+			dir, ok := w.dirs[wd]
+			if mask&syscall.IN_IGNORED != 0 {
+				delete(w.dirs, wd)
+			}
+			w.mu.Unlock()
+			if !ok || name == "" {
+				continue
+			}
+
+			rel := path.Join(dir, name)
+			isDir := mask&syscall.IN_ISDIR != 0
+			if w.ignore.ignored(rel, isDir) {
+				continue
+			}
+			changed := []string{rel}
+			if isDir && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+				// Files may have been created before the new directory was
+				// watched, so every file in it is treated as changed.
+				if changed, err = w.addTree(rel); err != nil {
+					LogWarn("Could not watch '%s' for changes: %s", rel, err)
+				}
+			}
+			for _, c := range changed {
+				w.ch <- c
+			}
+		}
+	}
+}
+
+func (w *notifyWatcher) changes() <-chan string {
+	return w.ch
+}
+
+func (w *notifyWatcher) close() error {
+	return w.f.Close()
+}
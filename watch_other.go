@@ -0,0 +1,11 @@
+//go:build !linux
+
+package sbbs
+
+import "errors"
+
+// Native file watching is only supported on linux, other platforms fall back
+// to polling for changes.
+func newNotifyWatcher(root string, ignore *gitignore) (fileWatcher, error) {
+	return nil, errors.New("Native file watching is not supported on this platform")
+}